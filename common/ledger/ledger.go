@@ -0,0 +1,130 @@
+// Package ledger - журнал операций с валютой игрока (двойная запись), общий
+// для pay (покупки и возвраты) и simple (траты, награды, история и сверка).
+package ledger
+
+import (
+	"net/http"
+	"time"
+
+	"common/middleware"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const Collection = "ledger"
+
+// Счета двойной записи. Счет игрока - "user" (с полем User_id),
+// остальные - внешние источники и получатели валюты.
+const (
+	AccountUser    = "user"
+	AccountShop    = "shop"    //покупки в pay
+	AccountGame    = "game"    //траты и награды в игре
+	AccountAdmin   = "admin"   //ручные начисления поддержки
+	AccountOpening = "opening" //баланс, который был до появления журнала
+)
+
+// Причины операций
+const (
+	ReasonPurchase = "purchase"
+	ReasonSpend    = "spend"
+	ReasonAward    = "award"
+	ReasonGrant    = "grant"
+	ReasonRefund   = "refund"
+	ReasonOpening  = "opening"
+	ReasonRestore  = "restore"
+)
+
+// Валюты - счетчики пользователя, которые учитываются в журнале
+var Currencies = []string{"live_count", "hint_fstep", "hint_back"}
+
+// Запись журнала: Amount единиц валюты переходит со счета From на счет To.
+// Записи не меняются и не удаляются, исправление - новая запись.
+type Entry struct {
+	ID          bson.ObjectId `json:"id" bson:"_id"`
+	User_id     string        `json:"user_id"`
+	Currency    string        `json:"currency"`
+	From        string        `json:"from"`
+	To          string        `json:"to"`
+	Amount      int           `json:"amount"`  //Всегда больше 0
+	Reason      string        `json:"reason"`  //purchase, spend, award, grant, refund, opening, restore
+	Ref         string        `json:"ref"`     //app_order_id, request_id и т.п.
+	Comment     string        `json:"comment"` //Для ручных операций
+	Balance     int           `json:"balance"` //Баланс игрока после операции
+	Date        int64         `json:"date"`
+	Opening_key string        `json:"-" bson:"opening_key,omitempty"` //Только у записи opening: "user_id|currency", уникальный
+}
+
+// OpeningKey - ключ записи opening игрока по валюте
+func OpeningKey(userID string, currency string) string {
+	return userID + "|" + currency
+}
+
+// EnsureIndex создает индексы журнала: история игрока по валюте и
+// уникальный ключ записи opening (у остальных записей его нет)
+func EnsureIndex(c *mgo.Collection) error {
+	err := c.EnsureIndex(mgo.Index{
+		Key:        []string{"user_id", "currency", "-date"},
+		Background: true,
+	})
+	if err != nil {
+		return err
+	}
+	return c.EnsureIndex(mgo.Index{
+		Key:        []string{"opening_key"},
+		Unique:     true,
+		Sparse:     true,
+		Background: true,
+	})
+}
+
+// Write записывает изменение баланса игрока с before на after.
+// Рост - перевод со счета other игроку, уменьшение - от игрока на other.
+// Перед первой записью по валюте фиксируется баланс, который был до журнала.
+func Write(r *http.Request, c *mgo.Collection, userID string, currency string, before int, after int, other string, reason string, ref string, comment string) error {
+	if before == after {
+		return nil
+	}
+	now := time.Now().Unix()
+
+	var count int
+	err := middleware.TraceDB(r, "count", c.Name, func() (err error) {
+		count, err = c.Find(bson.M{"user_id": userID, "currency": currency}).Count()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if count == 0 && before != 0 {
+		// Параллельные запросы оба видят пустой журнал, поэтому opening
+		// добавляется upsert по уникальному opening_key: запишется один раз
+		opening := Entry{ID: bson.NewObjectId(), User_id: userID, Currency: currency,
+			From: AccountOpening, To: AccountUser, Amount: before, Reason: ReasonOpening, Balance: before, Date: now,
+			Opening_key: OpeningKey(userID, currency)}
+		if before < 0 {
+			opening.From, opening.To, opening.Amount = AccountUser, AccountOpening, -before
+		}
+		err = middleware.TraceDB(r, "upsert", c.Name, func() error {
+			_, err := c.Upsert(bson.M{"opening_key": opening.Opening_key}, bson.M{"$setOnInsert": opening})
+			if mgo.IsDup(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	entry := Entry{ID: bson.NewObjectId(), User_id: userID, Currency: currency,
+		From: other, To: AccountUser, Amount: after - before, Reason: reason,
+		Ref: ref, Comment: comment, Balance: after, Date: now}
+	if after < before {
+		entry.From, entry.To, entry.Amount = AccountUser, other, before-after
+	}
+
+	return middleware.TraceDB(r, "insert", c.Name, func() error {
+		return c.Insert(entry)
+	})
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	corsAllowMethods = "GET, POST, OPTIONS, PUT, DELETE"
+	corsAllowHeaders = "Accept, Accept-Encoding, Destination, Content-Type, Content-Length, X-Request-Id, X-VK-Launch-Params"
+)
+
+// originAllowed проверяет Origin по списку разрешенных.
+// Элемент списка может быть точным origin (https://naogames.ru)
+// или маской поддоменов (https://*.vk.com).
+func originAllowed(origins []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, it := range origins {
+		if it == origin {
+			return true
+		}
+		if i := strings.Index(it, "*."); i >= 0 {
+			scheme, domain := it[:i], it[i+1:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CORS оборачивает весь роутер, а не отдельные маршруты, поэтому
+// preflight OPTIONS обрабатывается для любого пути, включая вложенные.
+// maxAge - время кеширования preflight в секундах.
+func CORS(origins []string, maxAge int, next http.Handler) http.Handler {
+	age := strconv.Itoa(maxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := originAllowed(origins, origin)
+
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !allowed {
+				ReqLog(r).Warn("cors origin rejected", "origin", origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", age)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,195 @@
+// Package middleware - обработчики http, общие для pay и simple: лог
+// запросов с request_id, CORS, лимиты запросов и трейсинг. Сервис
+// связывает их со своим конфигом в main.go.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const redacted = "[redacted]"
+
+// Поля, значения которых никогда не попадают в лог
+var redactedKeys = map[string]bool{
+	"sig":          true,
+	"access_token": true,
+	"token":        true,
+	"auth_key":     true,
+	"secret":       true,
+}
+
+type ctxKey int
+
+const requestIDKey ctxKey = 0
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Logger возвращает логгер сервиса (до InitLogger - json в stdout)
+func Logger() *slog.Logger {
+	return logger
+}
+
+// InitLogger настраивает json лог с уровнем level (debug, info, warn, error).
+// Одна запись - одна строка, так что вывод можно отдавать как в docker
+// (stdout), так и напрямую в syslog (udp://172.17.0.1:514), куда уже пишет
+// haproxy (local2).
+func InitLogger(level string, syslogAddr string, service string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+
+	var out io.Writer = os.Stdout
+	if syslogAddr != "" {
+		u, err := url.Parse(syslogAddr)
+		if err == nil {
+			var wr *syslog.Writer
+			wr, err = syslog.Dial(u.Scheme, u.Host, syslog.LOG_INFO|syslog.LOG_LOCAL2, service)
+			if err == nil {
+				out = wr
+			}
+		}
+		if err != nil {
+			logger.Error("syslog unavailable, using stdout", "addr", syslogAddr, "err", err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+	logger = slog.New(slog.NewJSONHandler(out, opts)).With("service", service)
+	slog.SetDefault(logger)
+	return logger
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[a.Key] {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// redactBody скрывает чувствительные поля в теле запроса (form или json)
+func redactBody(contentType string, body []byte) string {
+	if strings.HasPrefix(contentType, "application/json") {
+		var m map[string]interface{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			return string(body)
+		}
+		for k := range m {
+			if redactedKeys[k] {
+				m[k] = redacted
+			}
+		}
+		out, _ := json.Marshal(m)
+		return string(out)
+	}
+
+	pairs := strings.Split(string(body), "&")
+	for i, pair := range pairs {
+		z := strings.SplitN(pair, "=", 2)
+		if len(z) == 2 && redactedKeys[z[0]] {
+			pairs[i] = z[0] + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// BackgroundRequest - запрос-заглушка для фоновых задач, чтобы в них работали
+// ReqLog и TraceDB
+func BackgroundRequest(ctx context.Context, id string) *http.Request {
+	r, _ := http.NewRequestWithContext(context.WithValue(ctx, requestIDKey, id), "POST", "/", nil)
+	return r
+}
+
+// ReqLog возвращает логгер, в каждой строке которого есть request_id (и trace_id)
+func ReqLog(r *http.Request) *slog.Logger {
+	l := logger.With("request_id", RequestID(r))
+	if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	return l
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// WithRequestID берет X-Request-Id от haproxy (или создает новый), возвращает его
+// в ответе и пишет одну строку access лога на запрос
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = newRequestID()
+		}
+		TraceAttrs(r, attribute.String("request_id", id))
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+
+		ReqLog(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"forwarded_for", r.Header.Get("X-Forwarded-For"))
+	})
+}
+
+// LogBody пишет тело запроса (без чувствительных полей) на уровне debug,
+// только если маршрут есть в routes (LOG_BODY_ROUTES сервиса)
+func LogBody(routes []string, route string, h http.HandlerFunc) http.HandlerFunc {
+	enabled := false
+	for _, it := range routes {
+		if it == route {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ReqLog(r).Enabled(r.Context(), slog.LevelDebug) {
+			bodyBytes, _ := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+			ReqLog(r).Debug("request body", "route", route, "body", redactBody(r.Header.Get("Content-Type"), bodyBytes))
+		}
+		h(w, r)
+	}
+}
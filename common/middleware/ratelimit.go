@@ -0,0 +1,277 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Лимит запросов для маршрута: Rate запросов за Per, с запасом Burst
+type rateLimit struct {
+	Rate  float64
+	Per   time.Duration
+	Burst float64
+}
+
+// parseRateLimits разбирает список вида "PUT /users/:id=10/1m:20"
+// (маршрут=запросов/период[:burst]) в лимиты по маршрутам
+func parseRateLimits(list []string) map[string]rateLimit {
+	limits := make(map[string]rateLimit)
+	for _, it := range list {
+		z := strings.SplitN(it, "=", 2)
+		if len(z) != 2 {
+			logger.Error("bad rate limit", "value", it)
+			continue
+		}
+
+		spec := z[1]
+		burst := ""
+		if i := strings.Index(spec, ":"); i >= 0 {
+			spec, burst = spec[:i], spec[i+1:]
+		}
+		parts := strings.SplitN(spec, "/", 2)
+		if len(parts) != 2 {
+			logger.Error("bad rate limit", "value", it)
+			continue
+		}
+
+		var limit rateLimit
+		var err error
+		limit.Rate, err = strconv.ParseFloat(parts[0], 64)
+		if err == nil {
+			limit.Per, err = time.ParseDuration(parts[1])
+		}
+		limit.Burst = limit.Rate
+		if err == nil && burst != "" {
+			limit.Burst, err = strconv.ParseFloat(burst, 64)
+		}
+		if err != nil || limit.Rate <= 0 || limit.Per <= 0 {
+			logger.Error("bad rate limit", "value", it, "err", err)
+			continue
+		}
+		limits[strings.TrimSpace(z[0])] = limit
+	}
+	return limits
+}
+
+// Хранилище token bucket. Take забирает один токен по ключу и, если токенов нет,
+// возвращает через сколько он появится.
+type rateStore interface {
+	Take(key string, limit rateLimit, now time.Time) (bool, time.Duration)
+}
+
+// refill пересчитывает состояние корзины на момент now
+func refill(tokens float64, last time.Time, limit rateLimit, now time.Time) float64 {
+	elapsed := now.Sub(last).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens += elapsed * limit.Rate / limit.Per.Seconds()
+	return math.Min(tokens, limit.Burst)
+}
+
+func retryAfter(tokens float64, limit rateLimit) time.Duration {
+	need := 1 - tokens
+	return time.Duration(need * float64(limit.Per) / limit.Rate)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Состояние в памяти процесса. Подходит для одной реплики.
+type memoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	cleaned time.Time
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *memoryRateStore) Take(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, b.last, limit, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, retryAfter(b.tokens, limit)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup раз в минуту выбрасывает корзины, которые давно не трогали
+func (s *memoryRateStore) cleanup(now time.Time) {
+	if now.Sub(s.cleaned) < time.Minute {
+		return
+	}
+	s.cleaned = now
+	for key, b := range s.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// Состояние в mongodb, общее для всех реплик сервиса
+type mongoRateStore struct {
+	session *mgo.Session
+}
+
+type rateDoc struct {
+	Key    string    `bson:"_id"`
+	Tokens float64   `bson:"tokens"`
+	Last   time.Time `bson:"last"`
+}
+
+const rateLimitCollection = "ratelimit"
+
+func newMongoRateStore(s *mgo.Session) *mongoRateStore {
+	session := s.Copy()
+	defer session.Close()
+
+	c := session.DB("simple").C(rateLimitCollection)
+	index := mgo.Index{
+		Key:         []string{"last"},
+		Background:  true,
+		ExpireAfter: time.Hour,
+	}
+	err := c.EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+
+	return &mongoRateStore{session: s}
+}
+
+func (s *mongoRateStore) Take(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	c := session.DB("simple").C(rateLimitCollection)
+
+	// Оптимистичная блокировка по полю last: если другая реплика успела
+	// обновить корзину, перечитываем и пробуем еще раз
+	for try := 0; try < 3; try++ {
+		var doc rateDoc
+		err := c.FindId(key).One(&doc)
+		if err == mgo.ErrNotFound {
+			doc = rateDoc{Key: key, Tokens: limit.Burst - 1, Last: now}
+			err = c.Insert(doc)
+			if err == nil {
+				return true, 0
+			}
+			if mgo.IsDup(err) {
+				continue
+			}
+		}
+		if err != nil {
+			// База недоступна - не блокируем игроков из-за лимитера
+			logger.Error("rate limit store", "err", err)
+			return true, 0
+		}
+
+		tokens := refill(doc.Tokens, doc.Last, limit, now)
+		if tokens < 1 {
+			return false, retryAfter(tokens, limit)
+		}
+
+		err = c.Update(bson.M{"_id": key, "last": doc.Last}, bson.M{"$set": bson.M{"tokens": tokens - 1, "last": now}})
+		if err == nil {
+			return true, 0
+		}
+		if err != mgo.ErrNotFound {
+			logger.Error("rate limit store", "err", err)
+			return true, 0
+		}
+	}
+	return false, time.Second
+}
+
+// Limiter ограничивает маршруты по лимитам из конфига сервиса
+type Limiter struct {
+	limits map[string]rateLimit
+	store  rateStore
+	reject http.HandlerFunc
+}
+
+// NewLimiter разбирает лимиты (RATE_LIMITS) и выбирает хранилище: mongo -
+// общее для реплик, иначе в памяти процесса. reject отвечает на запрос
+// сверх лимита в формате ошибок сервиса, Retry-After уже выставлен.
+func NewLimiter(limits []string, store string, s *mgo.Session, reject http.HandlerFunc) *Limiter {
+	l := Limiter{limits: parseRateLimits(limits), reject: reject}
+	if store == "mongo" {
+		l.store = newMongoRateStore(s)
+	} else {
+		l.store = newMemoryRateStore()
+	}
+	return &l
+}
+
+// clientIP - адрес клиента. haproxy (option forwardfor) дописывает его последним
+// в X-Forwarded-For, предыдущие значения может подставить сам клиент.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Wrap ограничивает маршрут по лимиту из конфига отдельно для пользователя
+// (userID, может вернуть пустую строку) и для ip клиента
+func (l *Limiter) Wrap(route string, userID func(r *http.Request) string, h http.HandlerFunc) http.HandlerFunc {
+	limit, ok := l.limits[route]
+	if !ok {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		keys := []string{route + "|ip:" + clientIP(r)}
+		if userID != nil {
+			if id := userID(r); id != "" {
+				keys = append(keys, route+"|user:"+id)
+			}
+		}
+
+		for _, key := range keys {
+			allowed, wait := l.store.Take(key, limit, now)
+			if !allowed {
+				seconds := int(math.Ceil(wait.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				ReqLog(r).Warn("rate limited", "route", route, "key", key, "retry_after", seconds)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				l.reject(w, r)
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
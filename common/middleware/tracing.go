@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("")
+
+// Tracer - трейсер сервиса для собственных span
+func Tracer() trace.Tracer {
+	return tracer
+}
+
+// InitTracing настраивает экспорт трейсов: otlp (адрес берется из стандартной
+// OTEL_EXPORTER_OTLP_ENDPOINT), stdout для локальной разработки или ничего
+// (пустой exporter). Возвращает функцию, которую нужно вызвать перед выходом.
+func InitTracing(exporter string, service string) func() {
+	// Пропагатор нужен и без экспорта: trace_id из traceparent (его ставит
+	// haproxy) попадает в логи запроса
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	tracer = otel.Tracer(service)
+
+	var spans sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "otlp":
+		spans, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		spans, err = stdouttrace.New()
+	default:
+		return func() {}
+	}
+	if err != nil {
+		logger.Error("tracing disabled", "exporter", exporter, "err", err)
+		return func() {}
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spans),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(service)
+
+	logger.Info("tracing enabled", "exporter", exporter)
+	return func() {
+		provider.Shutdown(context.Background())
+	}
+}
+
+// WithTracing продолжает трейс из заголовков входящего запроса (traceparent)
+// и открывает серверный span на весь запрос
+func WithTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(clientIP(r)),
+			))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// TraceDB выполняет запрос к mongodb внутри отдельного span
+func TraceDB(r *http.Request, op string, collection string, f func() error) error {
+	_, span := tracer.Start(r.Context(), "mongo "+op+" "+collection,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMongoDB,
+			semconv.DBCollectionName(collection),
+			semconv.DBOperationName(op),
+		))
+	defer span.End()
+
+	err := f()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// TraceAttrs добавляет атрибуты к текущему span запроса
+func TraceAttrs(r *http.Request, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attrs...)
+}
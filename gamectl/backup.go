@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Копии базы simple. Каждая копия - каталог <id>/ с файлом на коллекцию
+// (<collection>.bson.gz, документы подряд, как у mongodump) и manifest.json,
+// который пишется последним: копия без него считается незаконченной.
+//
+// Запись в базу на время копии не блокируется, коллекции выгружаются по
+// очереди. Если mongodb запущена как replica set, вместе с копией
+// сохраняется oplog за время выгрузки (oplog.bson.gz), и при восстановлении
+// он доигрывается: данные возвращаются на момент окончания копии. На
+// одиночном сервере oplog нет, и такая копия помечается несогласованной.
+// Восстановить можно только состояние на момент одной из копий, а не на
+// произвольное время между ними.
+
+const (
+	backupIDFormat = "20060102T150405Z"
+	backupManifest = "manifest.json"
+	backupOplog    = "oplog.bson.gz"
+)
+
+type backupFile struct {
+	Collection string `json:"collection"`
+	Documents  int    `json:"documents"`
+	Bytes      int    `json:"bytes"`  //Размер сжатого файла
+	Sha256     string `json:"sha256"` //Контрольная сумма сжатого файла
+}
+
+type backupInfo struct {
+	ID         string           `json:"id"`
+	Date       int64            `json:"date"`
+	Database   string           `json:"database"`
+	Consistent bool             `json:"consistent"` //Есть oplog за время выгрузки
+	Files      []backupFile     `json:"files"`
+	Oplog      *backupOplogInfo `json:"oplog,omitempty"`
+}
+
+// Изменения коллекций копии, сделанные за время выгрузки
+type backupOplogInfo struct {
+	backupFile
+	Start int64 `json:"start"` //Позиция oplog (timestamp bson) перед выгрузкой
+	End   int64 `json:"end"`   //и после нее
+}
+
+// Правила хранения: сколько последних копий оставить и сколько дней,
+// недель и месяцев хранить по одной (самой новой) копии
+type backupRetention struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+func (r backupRetention) empty() bool {
+	return r.Last == 0 && r.Daily == 0 && r.Weekly == 0 && r.Monthly == 0
+}
+
+// Коллекции с данными игрока и поля, по которым документ относится к игроку
+var userDataFields = map[string][]string{
+	userCollection:      {"id"},
+	"ledger":            {"user_id"},
+	"levels":            {"user_id"},
+	"user_achievements": {"user_id"},
+	"daily_rewards":     {"user_id"},
+	"user_snapshots":    {"user_id"},
+	"inbox":             {"user_id"},
+	"cheat_violations":  {"user_id"},
+	"cheat_flags":       {"user_id"},
+	"users_deleted":     {"user_id"},
+	payCollection:       {"user_id", "receiver_id"},
+}
+
+// dumpIter выгружает документы во временный файл, сжимая их и считая
+// контрольную сумму по ходу записи, чтобы не держать коллекцию в памяти.
+// Файл закрывает и удаляет вызывающий.
+func dumpIter(iter *mgo.Iter, file *backupFile) (*os.File, error) {
+	f, err := ioutil.TempFile("", "gamectl-backup-")
+	if err != nil {
+		iter.Close()
+		return nil, err
+	}
+
+	sum := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(f, sum))
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		_, err = zw.Write(raw.Data)
+		if err != nil {
+			break
+		}
+		file.Documents++
+	}
+	if cerr := iter.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	file.Bytes = int(size)
+	file.Sha256 = hex.EncodeToString(sum.Sum(nil))
+	return f, nil
+}
+
+func uploadDump(store backupStore, name string, iter *mgo.Iter, file *backupFile) error {
+	f, err := dumpIter(iter, file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	return store.Put(name, f)
+}
+
+// fetchDump скачивает файл копии во временный файл и сверяет контрольную
+// сумму до того, как из него что-то восстановят
+func fetchDump(store backupStore, name string, sha string) (*os.File, error) {
+	body, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	f, err := ioutil.TempFile("", "gamectl-restore-")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, sum), body)
+	if err == nil && hex.EncodeToString(sum.Sum(nil)) != sha {
+		err = fmt.Errorf("checksum mismatch, backup is damaged")
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// readDump возвращает документы из файла копии
+func readDump(data io.Reader, f func(doc []byte) error) error {
+	zr, err := gzip.NewReader(data)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	size := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(zr, size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := int(binary.LittleEndian.Uint32(size))
+		if n < 5 {
+			return fmt.Errorf("bad document size %d", n)
+		}
+		doc := make([]byte, n)
+		copy(doc, size)
+		_, err = io.ReadFull(zr, doc[4:])
+		if err != nil {
+			return err
+		}
+		err = f(doc)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// oplogPosition возвращает последнюю запись oplog. На одиночном сервере
+// oplog нет, тогда ok = false.
+func oplogPosition(session *mgo.Session) (ts bson.MongoTimestamp, ok bool, err error) {
+	var master struct {
+		SetName string `bson:"setName"`
+	}
+	err = session.Run("isMaster", &master)
+	if err != nil || master.SetName == "" {
+		return 0, false, err
+	}
+
+	var last struct {
+		Ts bson.MongoTimestamp `bson:"ts"`
+	}
+	err = session.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&last)
+	return last.Ts, err == nil, err
+}
+
+// dumpOplog сохраняет изменения коллекций копии с позиции start до текущей
+func dumpOplog(store backupStore, session *mgo.Session, id string, collections []string, start bson.MongoTimestamp) (*backupOplogInfo, error) {
+	end, _, err := oplogPosition(session)
+	if err != nil {
+		return nil, err
+	}
+
+	// Если начало выгрузки уже вытеснено из oplog, часть изменений потеряна
+	oplog := session.DB("local").C("oplog.rs")
+	var first struct {
+		Ts bson.MongoTimestamp `bson:"ts"`
+	}
+	err = oplog.Find(nil).Sort("$natural").One(&first)
+	if err != nil {
+		return nil, err
+	}
+	if first.Ts > start {
+		return nil, fmt.Errorf("oplog rolled over during backup, oplog size is too small")
+	}
+
+	ns := []string{}
+	for _, name := range collections {
+		ns = append(ns, "simple."+name)
+	}
+	query := bson.M{
+		"ts": bson.M{"$gt": start, "$lte": end},
+		"ns": bson.M{"$in": ns},
+		"op": bson.M{"$in": []string{"i", "u", "d"}},
+	}
+	info := &backupOplogInfo{backupFile: backupFile{Collection: "local.oplog.rs"}, Start: int64(start), End: int64(end)}
+	err = uploadDump(store, id+"/"+backupOplog, oplog.Find(query).LogReplay().Iter(), &info.backupFile)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func runBackup(store backupStore, session *mgo.Session, collections []string) (backupInfo, error) {
+	now := time.Now().UTC()
+	info := backupInfo{ID: now.Format(backupIDFormat), Date: now.Unix(), Database: "simple"}
+
+	// Все чтения с одного сервера, иначе oplog может не совпасть с данными
+	session = session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Strong, false)
+	db := session.DB("simple")
+
+	if len(collections) == 0 {
+		names, err := db.CollectionNames()
+		if err != nil {
+			return info, fmt.Errorf("list collections: %v", err)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, "system.") {
+				collections = append(collections, name)
+			}
+		}
+	}
+
+	start, replica, err := oplogPosition(session)
+	if err != nil {
+		return info, fmt.Errorf("oplog: %v", err)
+	}
+
+	for _, name := range collections {
+		file := backupFile{Collection: name}
+		// Обход по индексу _id отдает каждый документ один раз, даже если
+		// документы меняются во время выгрузки
+		iter := db.C(name).Find(nil).Sort("_id").Iter()
+		err := uploadDump(store, info.ID+"/"+name+".bson.gz", iter, &file)
+		if err != nil {
+			return info, fmt.Errorf("dump %s: %v", name, err)
+		}
+		info.Files = append(info.Files, file)
+	}
+
+	if replica {
+		info.Oplog, err = dumpOplog(store, session, info.ID, collections, start)
+		if err != nil {
+			return info, fmt.Errorf("oplog: %v", err)
+		}
+		info.Consistent = true
+	}
+
+	manifest, _ := json.MarshalIndent(info, "", "  ")
+	err = store.Put(info.ID+"/"+backupManifest, bytes.NewReader(manifest))
+	if err != nil {
+		return info, fmt.Errorf("upload manifest: %v", err)
+	}
+	return info, nil
+}
+
+// listBackups возвращает законченные копии (новые первыми) и id незаконченных
+func listBackups(store backupStore) ([]backupInfo, []string, error) {
+	names, err := store.List("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := map[string]bool{}
+	complete := map[string]bool{}
+	for _, name := range names {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, err := time.Parse(backupIDFormat, parts[0]); err != nil {
+			continue
+		}
+		ids[parts[0]] = true
+		if parts[1] == backupManifest {
+			complete[parts[0]] = true
+		}
+	}
+
+	backups := []backupInfo{}
+	incomplete := []string{}
+	for id := range ids {
+		if !complete[id] {
+			incomplete = append(incomplete, id)
+			continue
+		}
+		body, err := store.Get(id + "/" + backupManifest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", id, err)
+		}
+		var info backupInfo
+		err = json.NewDecoder(body).Decode(&info)
+		body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", id, err)
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID > backups[j].ID })
+	sort.Strings(incomplete)
+	return backups, incomplete, nil
+}
+
+// retainBackups выбирает копии, которые нужно оставить по правилам хранения
+func retainBackups(backups []backupInfo, rules backupRetention) map[string]bool {
+	keep := map[string]bool{}
+	for i, it := range backups {
+		if i < rules.Last {
+			keep[it.ID] = true
+		}
+	}
+
+	periods := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{rules.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{rules.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{rules.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range periods {
+		seen := map[string]bool{}
+		for _, it := range backups {
+			key := p.period(time.Unix(it.Date, 0).UTC())
+			if !seen[key] && len(seen) < p.count {
+				seen[key] = true
+				keep[it.ID] = true
+			}
+		}
+	}
+	return keep
+}
+
+func deleteBackup(store backupStore, id string) error {
+	names, err := store.List(id + "/")
+	if err != nil {
+		return err
+	}
+	// Манифест удаляется первым: копия сразу перестает считаться целой
+	for i, name := range names {
+		if strings.HasSuffix(name, "/"+backupManifest) {
+			names[0], names[i] = names[i], names[0]
+		}
+	}
+	for _, name := range names {
+		err := store.Delete(name)
+		if err != nil {
+			return fmt.Errorf("delete %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// pruneBackups удаляет копии, не попавшие под правила хранения, и
+// незаконченные копии старше последней целой
+func pruneBackups(store backupStore, rules backupRetention) error {
+	backups, incomplete, err := listBackups(store)
+	if err != nil {
+		return err
+	}
+
+	keep := retainBackups(backups, rules)
+	for _, it := range backups {
+		if keep[it.ID] {
+			continue
+		}
+		err := deleteBackup(store, it.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %s\n", it.ID)
+	}
+	for _, id := range incomplete {
+		if len(backups) == 0 || id >= backups[0].ID {
+			continue
+		}
+		err := deleteBackup(store, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted incomplete %s\n", id)
+	}
+	return nil
+}
+
+func retentionFlags(flags *flag.FlagSet) *backupRetention {
+	var rules backupRetention
+	flags.IntVar(&rules.Last, "keep-last", 0, "keep N latest backups")
+	flags.IntVar(&rules.Daily, "keep-daily", 0, "keep one backup per day for N days")
+	flags.IntVar(&rules.Weekly, "keep-weekly", 0, "keep one backup per week for N weeks")
+	flags.IntVar(&rules.Monthly, "keep-monthly", 0, "keep one backup per month for N months")
+	return &rules
+}
+
+func backupRun(args []string) error {
+	flags := flag.NewFlagSet("backup run", flag.ExitOnError)
+	to := flags.String("to", os.Getenv("BACKUP_TO"), "backup location: directory or s3://bucket/prefix")
+	only := flags.String("c", "", "comma separated collections (all if empty)")
+	every := flags.Duration("every", 0, "repeat with this interval instead of running once")
+	rules := retentionFlags(flags)
+	mongoURL := flags.String("mongo", defaultMongoURL(), "mongodb connection string")
+	flags.Parse(args)
+
+	store, err := openStore(*to)
+	if err != nil {
+		return err
+	}
+
+	collections := []string{}
+	for _, it := range strings.Split(*only, ",") {
+		if it = strings.TrimSpace(it); it != "" {
+			collections = append(collections, it)
+		}
+	}
+
+	session, err := dial(*mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for {
+		start := time.Now()
+		info, err := runBackup(store, session, collections)
+		if err == nil {
+			docs := 0
+			for _, file := range info.Files {
+				docs += file.Documents
+			}
+			fmt.Printf("backup %s: %d collections, %d documents in %s\n", info.ID, len(info.Files), docs, time.Since(start).Round(time.Millisecond))
+			if !rules.empty() {
+				err = pruneBackups(store, *rules)
+			}
+		}
+
+		if *every == 0 {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			session.Refresh()
+		}
+		time.Sleep(*every - time.Since(start)%*every)
+	}
+}
+
+func backupList(args []string) error {
+	flags := flag.NewFlagSet("backup list", flag.ExitOnError)
+	to := flags.String("to", os.Getenv("BACKUP_TO"), "backup location: directory or s3://bucket/prefix")
+	flags.Parse(args)
+
+	store, err := openStore(*to)
+	if err != nil {
+		return err
+	}
+	backups, incomplete, err := listBackups(store)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "id\tcollections\tdocuments\tbytes\tconsistent")
+	for _, it := range backups {
+		docs, size := 0, 0
+		for _, file := range it.Files {
+			docs += file.Documents
+			size += file.Bytes
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%v\n", it.ID, len(it.Files), docs, size, it.Consistent)
+	}
+	for _, id := range incomplete {
+		fmt.Fprintf(w, "%s\tincomplete\t\t\t\n", id)
+	}
+	return w.Flush()
+}
+
+func backupPrune(args []string) error {
+	flags := flag.NewFlagSet("backup prune", flag.ExitOnError)
+	to := flags.String("to", os.Getenv("BACKUP_TO"), "backup location: directory or s3://bucket/prefix")
+	rules := retentionFlags(flags)
+	flags.Parse(args)
+
+	if rules.empty() {
+		flags.Usage()
+		return fmt.Errorf("at least one -keep-* rule is required")
+	}
+	store, err := openStore(*to)
+	if err != nil {
+		return err
+	}
+	return pruneBackups(store, *rules)
+}
+
+// Режимы восстановления
+const (
+	restoreUpsert  = "upsert"  //документы из копии заменяют текущие с тем же _id
+	restoreSkip    = "skip"    //документы, которые уже есть, не трогать
+	restoreReplace = "replace" //сначала удалить текущие (коллекцию или данные игрока)
+)
+
+type restoreStats struct {
+	Read     int
+	Restored int
+	Existing int
+	Removed  int
+	Replayed int
+}
+
+// userQuery - документы игрока в коллекции. id VK в pay - число.
+func userQuery(collection string, user string) bson.M {
+	or := []bson.M{}
+	for _, field := range userDataFields[collection] {
+		if id, err := strconv.Atoi(user); err == nil && collection == payCollection {
+			or = append(or, bson.M{field: id})
+			continue
+		}
+		or = append(or, bson.M{field: user})
+	}
+	return bson.M{"$or": or}
+}
+
+// matchUser проверяет документ из копии на принадлежность игроку
+func matchUser(collection string, user string, doc bson.M) bool {
+	for _, field := range userDataFields[collection] {
+		if val, ok := doc[field]; ok && fmt.Sprint(val) == user {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreCollection восстанавливает документы из копии. Если ids не nil,
+// в него записываются _id восстановленных документов для replayOplog.
+func restoreCollection(c *mgo.Collection, data io.Reader, user string, mode string, dryRun bool, ids map[string]bool) (restoreStats, error) {
+	var stats restoreStats
+
+	if mode == restoreReplace && !dryRun {
+		query := bson.M{}
+		if user != "" {
+			query = userQuery(c.Name, user)
+		}
+		info, err := c.RemoveAll(query)
+		if err != nil {
+			return stats, err
+		}
+		stats.Removed = info.Removed
+	}
+
+	err := readDump(data, func(doc []byte) error {
+		var fields bson.M
+		err := bson.Unmarshal(doc, &fields)
+		if err != nil {
+			return err
+		}
+		if user != "" && !matchUser(c.Name, user, fields) {
+			return nil
+		}
+		stats.Read++
+		if dryRun {
+			if ids != nil {
+				ids[fmt.Sprint(fields["_id"])] = true
+			}
+			return nil
+		}
+
+		raw := bson.Raw{Kind: 0x03, Data: doc}
+		switch mode {
+		case restoreUpsert:
+			_, err = c.UpsertId(fields["_id"], raw)
+		default:
+			err = c.Insert(raw)
+			if mgo.IsDup(err) {
+				stats.Existing++
+				return nil
+			}
+		}
+		if err == nil {
+			stats.Restored++
+			if ids != nil {
+				ids[fmt.Sprint(fields["_id"])] = true
+			}
+		}
+		return err
+	})
+	return stats, err
+}
+
+// replayOplog доигрывает изменения, сделанные во время выгрузки. Они
+// применяются только к восстановленным документам и к новым документам
+// (для -user - документам игрока), которых сейчас нет в базе: документы,
+// оставленные как есть (-mode skip), не трогаются.
+func replayOplog(c *mgo.Collection, data io.Reader, user string, dryRun bool, ids map[string]bool) (int, error) {
+	ns := c.Database.Name + "." + c.Name
+	replayed := 0
+	err := readDump(data, func(doc []byte) error {
+		var entry struct {
+			Ns string `bson:"ns"`
+			Op string `bson:"op"`
+			O  bson.M `bson:"o"`
+			O2 bson.M `bson:"o2"`
+		}
+		err := bson.Unmarshal(doc, &entry)
+		if err != nil || entry.Ns != ns {
+			return err
+		}
+
+		id := entry.O["_id"]
+		if entry.Op == "u" {
+			id = entry.O2["_id"]
+		}
+		key := fmt.Sprint(id)
+		if !ids[key] {
+			if entry.Op != "i" || (user != "" && !matchUser(c.Name, user, entry.O)) {
+				return nil
+			}
+			n, err := c.FindId(id).Count()
+			if err != nil || n > 0 {
+				return err
+			}
+			ids[key] = true
+		}
+
+		replayed++
+		if dryRun {
+			return nil
+		}
+		return c.Database.Run(bson.D{{Name: "applyOps", Value: []bson.Raw{{Kind: 0x03, Data: doc}}}}, nil)
+	})
+	return replayed, err
+}
+
+func backupRestore(args []string) error {
+	flags := flag.NewFlagSet("backup restore", flag.ExitOnError)
+	from := flags.String("from", os.Getenv("BACKUP_TO"), "backup location: directory or s3://bucket/prefix")
+	id := flags.String("id", "latest", "backup id (see backup list)")
+	collection := flags.String("c", "", "restore only this collection")
+	user := flags.String("user", "", "restore only this player's data")
+	mode := flags.String("mode", restoreUpsert, "upsert, skip (keep existing documents) or replace (remove current data first)")
+	dryRun := flags.Bool("dry-run", false, "show what would be restored")
+	mongoURL := flags.String("mongo", defaultMongoURL(), "mongodb connection string")
+	flags.Parse(args)
+
+	if *collection == "" && *user == "" {
+		flags.Usage()
+		return fmt.Errorf("-c or -user is required")
+	}
+	if *mode != restoreUpsert && *mode != restoreSkip && *mode != restoreReplace {
+		return fmt.Errorf("-mode must be %s, %s or %s", restoreUpsert, restoreSkip, restoreReplace)
+	}
+	if *user != "" && *collection != "" && userDataFields[*collection] == nil {
+		return fmt.Errorf("%s has no player data", *collection)
+	}
+
+	store, err := openStore(*from)
+	if err != nil {
+		return err
+	}
+	backups, _, err := listBackups(store)
+	if err != nil {
+		return err
+	}
+	var info *backupInfo
+	for i, it := range backups {
+		if it.ID == *id || (*id == "latest" && i == 0) {
+			info = &backups[i]
+			break
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("backup %s not found", *id)
+	}
+
+	files := []backupFile{}
+	for _, file := range info.Files {
+		if *collection != "" && file.Collection != *collection {
+			continue
+		}
+		if *user != "" && userDataFields[file.Collection] == nil {
+			continue
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("backup %s has no matching collections", info.ID)
+	}
+
+	session, err := dial(*mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var oplog *os.File
+	if info.Oplog != nil {
+		oplog, err = fetchDump(store, info.ID+"/"+backupOplog, info.Oplog.Sha256)
+		if err != nil {
+			return fmt.Errorf("oplog: %v", err)
+		}
+		defer os.Remove(oplog.Name())
+		defer oplog.Close()
+	}
+
+	fmt.Printf("restoring from %s\n", info.ID)
+	if oplog == nil {
+		fmt.Println("backup has no oplog, collections are restored as they were dumped one by one")
+	}
+	for _, file := range files {
+		stats, err := restoreFile(session.DB("simple").C(file.Collection), store, info.ID, file, oplog, *user, *mode, *dryRun)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file.Collection, err)
+		}
+		if *dryRun {
+			fmt.Printf("%s: %d documents would be restored, %d changes replayed\n", file.Collection, stats.Read, stats.Replayed)
+			continue
+		}
+		fmt.Printf("%s: removed %d, restored %d, existing %d, replayed %d\n", file.Collection, stats.Removed, stats.Restored, stats.Existing, stats.Replayed)
+	}
+	return nil
+}
+
+// restoreFile восстанавливает одну коллекцию и доигрывает по ней oplog
+func restoreFile(c *mgo.Collection, store backupStore, id string, file backupFile, oplog *os.File, user string, mode string, dryRun bool) (restoreStats, error) {
+	data, err := fetchDump(store, id+"/"+file.Collection+".bson.gz", file.Sha256)
+	if err != nil {
+		return restoreStats{}, err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	var ids map[string]bool
+	if oplog != nil {
+		ids = map[string]bool{}
+	}
+	stats, err := restoreCollection(c, data, user, mode, dryRun, ids)
+	if err != nil || oplog == nil {
+		return stats, err
+	}
+
+	_, err = oplog.Seek(0, io.SeekStart)
+	if err != nil {
+		return stats, err
+	}
+	stats.Replayed, err = replayOplog(c, oplog, user, dryRun, ids)
+	return stats, err
+}
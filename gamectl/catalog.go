@@ -0,0 +1,398 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/yaml.v2"
+)
+
+const showcaseCollection = "showcase"
+
+// Что товар дает игроку, общая таблица для pay и simple
+const effectsCollection = "item_effects"
+
+// Товар витрины, то же что Item в pay
+type Item struct {
+	App_id        int               `json:"app_id" yaml:"app_id"`
+	Item          string            `json:"item" yaml:"item"`
+	Title         string            `json:"title" yaml:"title"`
+	Titles        map[string]string `json:"titles" yaml:"titles"`
+	Description   string            `json:"description" yaml:"description"`
+	Descriptions  map[string]string `json:"descriptions" yaml:"descriptions"`
+	Photo_url     string            `json:"photo_url" yaml:"photo_url"`
+	Price         int               `json:"price" yaml:"price"`
+	Item_id       string            `json:"item_id" yaml:"item_id"`
+	Sale_price    int               `json:"sale_price" yaml:"sale_price"`
+	Sale_start    int64             `json:"sale_start" yaml:"sale_start"`
+	Sale_end      int64             `json:"sale_end" yaml:"sale_end"`
+	Sale_limit    int               `json:"sale_limit" yaml:"sale_limit"`
+	Limit_total   int               `json:"limit_total" yaml:"limit_total"`
+	Limit_daily   int               `json:"limit_daily" yaml:"limit_daily"`
+	Unless_all_ok bool              `json:"unless_all_ok" yaml:"unless_all_ok"`
+	Bundle        []BundlePart      `json:"bundle" yaml:"bundle"`
+}
+
+type BundlePart struct {
+	Item  string `json:"item" yaml:"item"`
+	Count int    `json:"count" yaml:"count"`
+}
+
+// Действие обычного товара на игрока, то же что itemEffect в pay и simple
+type ItemEffect struct {
+	Item       string `json:"item" yaml:"-" bson:"_id"`
+	All_ok     bool   `json:"all_ok" yaml:"all_ok"`
+	Live_count int    `json:"live_count" yaml:"live_count"`
+	Hint_fstep int    `json:"hint_fstep" yaml:"hint_fstep"`
+	Hint_back  int    `json:"hint_back" yaml:"hint_back"`
+	Reset      bool   `json:"reset" yaml:"reset"`
+}
+
+type catalogFile struct {
+	Effects map[string]ItemEffect `yaml:"effects"`
+	Items   []Item                `yaml:"items"`
+}
+
+type itemKey struct {
+	App_id int
+	Item   string
+}
+
+func keyOf(it Item) itemKey {
+	return itemKey{it.App_id, it.Item}
+}
+
+func (k itemKey) String() string {
+	return fmt.Sprintf("app_id=%d item=%s", k.App_id, k.Item)
+}
+
+// loadCatalog читает файл витрины. Неизвестные поля считаются ошибкой,
+// чтобы опечатка в имени поля не превратилась в пустое значение в базе.
+func loadCatalog(path string) ([]Item, []ItemEffect, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file catalogFile
+	err = yaml.UnmarshalStrict(data, &file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	effects := []ItemEffect{}
+	for name, it := range file.Effects {
+		it.Item = name
+		effects = append(effects, it)
+	}
+	sort.Slice(effects, func(i, j int) bool { return effects[i].Item < effects[j].Item })
+
+	err = validateCatalog(file.Items, effects)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// Прогоняем через bson, чтобы сравнение с базой не видело разницы
+	// между пустыми и отсутствующими полями
+	for i, it := range file.Items {
+		data, err := bson.Marshal(it)
+		if err == nil {
+			var norm Item
+			err = bson.Unmarshal(data, &norm)
+			file.Items[i] = norm
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", keyOf(it), err)
+		}
+	}
+	return file.Items, effects, nil
+}
+
+func validateCatalog(items []Item, effects []ItemEffect) error {
+	keys := make(map[itemKey]bool)
+	ids := make(map[string]bool)
+	for i, it := range items {
+		switch {
+		case it.App_id <= 0:
+			return fmt.Errorf("item #%d: app_id is required", i+1)
+		case it.Item == "":
+			return fmt.Errorf("item #%d: item is required", i+1)
+		case it.Title == "":
+			return fmt.Errorf("%s: title is required", keyOf(it))
+		case it.Photo_url == "":
+			return fmt.Errorf("%s: photo_url is required", keyOf(it))
+		case it.Price <= 0:
+			return fmt.Errorf("%s: price must be positive", keyOf(it))
+		case it.Item_id == "":
+			return fmt.Errorf("%s: item_id is required", keyOf(it))
+		case it.Sale_price < 0 || it.Sale_price >= it.Price:
+			return fmt.Errorf("%s: sale_price must be below price", keyOf(it))
+		case it.Sale_end > 0 && it.Sale_end <= it.Sale_start:
+			return fmt.Errorf("%s: sale_end must be after sale_start", keyOf(it))
+		case it.Sale_limit < 0:
+			return fmt.Errorf("%s: sale_limit must not be negative", keyOf(it))
+		case it.Limit_total < 0 || it.Limit_daily < 0:
+			return fmt.Errorf("%s: limits must not be negative", keyOf(it))
+		}
+
+		err := validateLangs(it.Titles)
+		if err == nil {
+			err = validateLangs(it.Descriptions)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", keyOf(it), err)
+		}
+
+		if keys[keyOf(it)] {
+			return fmt.Errorf("%s: duplicate item", keyOf(it))
+		}
+		keys[keyOf(it)] = true
+
+		id := fmt.Sprintf("%d/%s", it.App_id, it.Item_id)
+		if ids[id] {
+			return fmt.Errorf("%s: duplicate item_id %s", keyOf(it), it.Item_id)
+		}
+		ids[id] = true
+	}
+
+	// Каждый обычный товар должен что-то давать игроку
+	byName := make(map[string]bool)
+	for _, it := range effects {
+		if it.Live_count < 0 || it.Hint_fstep < 0 || it.Hint_back < 0 {
+			return fmt.Errorf("effect %s: counts must not be negative", it.Item)
+		}
+		if !it.All_ok && !it.Reset && it.Live_count == 0 && it.Hint_fstep == 0 && it.Hint_back == 0 {
+			return fmt.Errorf("effect %s is empty", it.Item)
+		}
+		byName[it.Item] = true
+	}
+	for _, it := range items {
+		if len(it.Bundle) == 0 && !byName[it.Item] {
+			return fmt.Errorf("%s: no effect for item", keyOf(it))
+		}
+	}
+
+	// Состав набора - только обычные товары того же приложения
+	byKey := make(map[itemKey]Item)
+	for _, it := range items {
+		byKey[keyOf(it)] = it
+	}
+	for _, it := range items {
+		for _, part := range it.Bundle {
+			base, ok := byKey[itemKey{it.App_id, part.Item}]
+			switch {
+			case !ok:
+				return fmt.Errorf("%s: bundle item %s not found", keyOf(it), part.Item)
+			case len(base.Bundle) > 0:
+				return fmt.Errorf("%s: bundle item %s is a bundle itself", keyOf(it), part.Item)
+			case part.Count <= 0:
+				return fmt.Errorf("%s: bundle item %s count must be positive", keyOf(it), part.Item)
+			}
+		}
+	}
+	return nil
+}
+
+// validateLangs проверяет переводы: ключ - код языка в нижнем регистре (ru, en_us)
+func validateLangs(values map[string]string) error {
+	for lang, val := range values {
+		if lang == "" || lang != strings.ToLower(lang) {
+			return fmt.Errorf("bad language code %q", lang)
+		}
+		if val == "" {
+			return fmt.Errorf("empty translation for %s", lang)
+		}
+	}
+	return nil
+}
+
+type catalogChange struct {
+	Op   string // insert, update, delete
+	Key  itemKey
+	Item Item
+}
+
+// diffCatalog сравнивает файл с витриной в базе. Удаляются только товары
+// тех приложений, которые есть в файле - чужие app_id не трогаем.
+func diffCatalog(want []Item, live []Item) []catalogChange {
+	apps := make(map[int]bool)
+	wantByKey := make(map[itemKey]Item)
+	for _, it := range want {
+		apps[it.App_id] = true
+		wantByKey[keyOf(it)] = it
+	}
+	liveByKey := make(map[itemKey]Item)
+	for _, it := range live {
+		liveByKey[keyOf(it)] = it
+	}
+
+	changes := []catalogChange{}
+	for key, it := range wantByKey {
+		old, ok := liveByKey[key]
+		if !ok {
+			changes = append(changes, catalogChange{"insert", key, it})
+		} else if !reflect.DeepEqual(old, it) {
+			changes = append(changes, catalogChange{"update", key, it})
+		}
+	}
+	for key, it := range liveByKey {
+		if _, ok := wantByKey[key]; !ok && apps[key.App_id] {
+			changes = append(changes, catalogChange{"delete", key, it})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i].Key, changes[j].Key
+		if a.App_id != b.App_id {
+			return a.App_id < b.App_id
+		}
+		return a.Item < b.Item
+	})
+	return changes
+}
+
+// applyCatalog применяет изменения по одному товару. Коллекция не удаляется,
+// поэтому get_item все время видит либо старую, либо новую версию товара.
+func applyCatalog(c *mgo.Collection, changes []catalogChange) error {
+	for _, ch := range changes {
+		selector := bson.M{"app_id": ch.Key.App_id, "item": ch.Key.Item}
+
+		var err error
+		switch ch.Op {
+		case "insert":
+			err = c.Insert(ch.Item)
+		case "update":
+			err = c.Update(selector, ch.Item)
+		case "delete":
+			err = c.Remove(selector)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", ch.Op, ch.Key, err)
+		}
+	}
+	return nil
+}
+
+type effectChange struct {
+	Op     string // insert, update, delete
+	Effect ItemEffect
+}
+
+// diffEffects сравнивает таблицу действий товаров из файла с базой.
+// Таблица одна на все приложения, лишние записи удаляются.
+func diffEffects(want []ItemEffect, live []ItemEffect) []effectChange {
+	liveByName := make(map[string]ItemEffect)
+	for _, it := range live {
+		liveByName[it.Item] = it
+	}
+	wantByName := make(map[string]bool)
+
+	changes := []effectChange{}
+	for _, it := range want {
+		wantByName[it.Item] = true
+		old, ok := liveByName[it.Item]
+		if !ok {
+			changes = append(changes, effectChange{"insert", it})
+		} else if old != it {
+			changes = append(changes, effectChange{"update", it})
+		}
+	}
+	for _, it := range live {
+		if !wantByName[it.Item] {
+			changes = append(changes, effectChange{"delete", it})
+		}
+	}
+	return changes
+}
+
+func applyEffects(c *mgo.Collection, changes []effectChange) error {
+	for _, ch := range changes {
+		var err error
+		switch ch.Op {
+		case "insert":
+			err = c.Insert(ch.Effect)
+		case "update":
+			err = c.UpdateId(ch.Effect.Item, ch.Effect)
+		case "delete":
+			err = c.RemoveId(ch.Effect.Item)
+		}
+		if err != nil {
+			return fmt.Errorf("%s effect %s: %v", ch.Op, ch.Effect.Item, err)
+		}
+	}
+	return nil
+}
+
+func catalogApply(args []string) error {
+	flags := flag.NewFlagSet("catalog apply", flag.ExitOnError)
+	path := flags.String("f", "", "items file (yaml)")
+	dryRun := flags.Bool("dry-run", false, "show changes without applying them")
+	mongoURL := flags.String("mongo", defaultMongoURL(), "mongodb connection string")
+	flags.Parse(args)
+
+	if *path == "" {
+		flags.Usage()
+		return fmt.Errorf("-f is required")
+	}
+
+	items, effects, err := loadCatalog(*path)
+	if err != nil {
+		return err
+	}
+
+	session, err := dial(*mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("simple").C(showcaseCollection)
+
+	var live []Item
+	err = c.Find(bson.M{}).All(&live)
+	if err != nil {
+		return fmt.Errorf("read showcase: %v", err)
+	}
+
+	c_effects := session.DB("simple").C(effectsCollection)
+
+	var liveEffects []ItemEffect
+	err = c_effects.Find(bson.M{}).All(&liveEffects)
+	if err != nil {
+		return fmt.Errorf("read item effects: %v", err)
+	}
+
+	effectChanges := diffEffects(effects, liveEffects)
+	for _, ch := range effectChanges {
+		fmt.Printf("%-6s effect %s\n", ch.Op, ch.Effect.Item)
+	}
+	changes := diffCatalog(items, live)
+	for _, ch := range changes {
+		fmt.Printf("%-6s %s\n", ch.Op, ch.Key)
+	}
+	total := len(effectChanges) + len(changes)
+	if total == 0 {
+		fmt.Println("catalog is up to date")
+		return nil
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %d changes not applied\n", total)
+		return nil
+	}
+
+	// Сначала действия товаров, чтобы новый товар витрины сразу можно было выдать
+	err = applyEffects(c_effects, effectChanges)
+	if err == nil {
+		err = applyCatalog(c, changes)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("applied %d changes\n", total)
+	return nil
+}
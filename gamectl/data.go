@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Выгрузка и загрузка коллекций в NDJSON: одна строка - один документ
+// в том виде, как он лежит в базе, без _id. Так данные можно переносить
+// между окружениями и восстанавливать из частичных копий.
+
+const userCollection = "users_arrows"
+
+// Игрок в том виде, как его пишут simple и pay (поля без bson тегов)
+type userRecord struct {
+	ID         string `json:"id"`
+	LvlOk      string `json:"lvlok"`
+	AllOk      string `json:"allok"`
+	HintFstep  string `json:"hintfstep"`
+	HintBack   string `json:"hintback"`
+	LiveCount  string `json:"livecount"`
+	LiveTime   string `json:"livetime"`
+	PriceTime  string `json:"pricetime"`
+	GameTime   string `json:"gametime"`
+	GamePoints string `json:"gamepoints"`
+	GameLvlTry string `json:"gamelvltry"`
+	Sound      string `json:"sound"`
+	Music      string `json:"music"`
+	Reserve1   string `json:"reserve1"`
+	Reserve2   string `json:"reserve2"`
+	Reserve3   string `json:"reserve3"`
+	Reserve4   string `json:"reserve4"`
+}
+
+// Коллекция для выгрузки: ключ документа (по нему сортировка, продолжение
+// выгрузки и поиск при загрузке) и проверка записи перед загрузкой
+type dataCollection struct {
+	Keys  []string
+	Parse func(line []byte) (interface{}, bson.M, error) //документ для записи и его ключ
+}
+
+var dataCollections = map[string]dataCollection{
+	userCollection:     {[]string{"id"}, parseUserRecord},
+	payCollection:      {[]string{"app_order_id"}, parsePayRecord},
+	showcaseCollection: {[]string{"app_id", "item"}, parseShowcaseRecord},
+}
+
+// Режимы загрузки
+const (
+	importSkip   = "skip"   //существующие документы не трогать
+	importUpsert = "upsert" //существующие заменить
+)
+
+// parseUserRecord проверяет игрока по модели: только известные поля,
+// числовые поля - числа
+func parseUserRecord(line []byte) (interface{}, bson.M, error) {
+	var user userRecord
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.ID == "" {
+		return nil, nil, fmt.Errorf("id is required")
+	}
+	numbers := map[string]string{
+		"lvlok": user.LvlOk, "hintfstep": user.HintFstep, "hintback": user.HintBack,
+		"livecount": user.LiveCount, "livetime": user.LiveTime, "pricetime": user.PriceTime,
+		"gametime": user.GameTime, "gamepoints": user.GamePoints, "gamelvltry": user.GameLvlTry,
+	}
+	for field, val := range numbers {
+		if _, err := strconv.Atoi(val); val != "" && err != nil {
+			return nil, nil, fmt.Errorf("id=%s: %s must be a number, got %q", user.ID, field, val)
+		}
+	}
+	if user.AllOk != "" && user.AllOk != "0" && user.AllOk != "1" {
+		return nil, nil, fmt.Errorf("id=%s: allok must be 0 or 1, got %q", user.ID, user.AllOk)
+	}
+	return user, bson.M{"id": user.ID}, nil
+}
+
+// parsePayRecord проверяет обязательные поля заказа. Остальные поля заказа
+// переносятся как есть: модель в pay меняется чаще, чем эта утилита.
+func parsePayRecord(line []byte) (interface{}, bson.M, error) {
+	var order struct {
+		App_order_id int    `json:"app_order_id"`
+		App_id       int    `json:"app_id"`
+		User_id      int    `json:"user_id"`
+		Receiver_id  int    `json:"receiver_id"`
+		Order_id     int    `json:"order_id"`
+		Item         string `json:"item"`
+		State        string `json:"state"`
+	}
+	err := json.Unmarshal(line, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	if order.App_order_id <= 0 || order.App_id <= 0 || order.Order_id <= 0 {
+		return nil, nil, fmt.Errorf("app_order_id=%d: app_order_id, app_id and order_id are required", order.App_order_id)
+	}
+
+	doc, err := decodeDocument(line)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, bson.M{"app_order_id": order.App_order_id}, nil
+}
+
+func parseShowcaseRecord(line []byte) (interface{}, bson.M, error) {
+	var it Item
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&it)
+	if err != nil {
+		return nil, nil, err
+	}
+	if it.App_id <= 0 || it.Item == "" || it.Item_id == "" {
+		return nil, nil, fmt.Errorf("%s: app_id, item and item_id are required", keyOf(it))
+	}
+	return it, bson.M{"app_id": it.App_id, "item": it.Item}, nil
+}
+
+// decodeDocument читает документ без схемы. Целые числа остаются целыми,
+// иначе json превратил бы их в double в базе.
+func decodeDocument(data []byte) (bson.M, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeValue(doc).(bson.M), nil
+}
+
+func normalizeValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return int(n)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		doc := bson.M{}
+		for key, it := range v {
+			doc[key] = normalizeValue(it)
+		}
+		return doc
+	case []interface{}:
+		for i, it := range v {
+			v[i] = normalizeValue(it)
+		}
+		return v
+	}
+	return val
+}
+
+// parseFilter - фильтр из флага -filter, запрос mongodb в json
+func parseFilter(filter string) (bson.M, error) {
+	if filter == "" {
+		return bson.M{}, nil
+	}
+	query, err := decodeDocument([]byte(filter))
+	if err != nil {
+		return nil, fmt.Errorf("-filter: %v", err)
+	}
+	return query, nil
+}
+
+// afterKey - условие "ключ больше last" для сортировки по составному ключу
+func afterKey(keys []string, last bson.M) bson.M {
+	or := []bson.M{}
+	for i := range keys {
+		cond := bson.M{}
+		for _, key := range keys[:i] {
+			cond[key] = last[key]
+		}
+		cond[keys[i]] = bson.M{"$gt": last[keys[i]]}
+		or = append(or, cond)
+	}
+	return bson.M{"$or": or}
+}
+
+// lastLine находит последнюю целую строку файла выгрузки и отрезает
+// недописанный хвост, если выгрузка оборвалась посреди строки
+func lastLine(f *os.File) ([]byte, error) {
+	var last []byte
+	var size int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += int64(len(line))
+		if len(bytes.TrimSpace(line)) > 0 {
+			last = line
+		}
+	}
+	err := f.Truncate(size)
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	return last, err
+}
+
+func dataExport(args []string) error {
+	flags := flag.NewFlagSet("data export", flag.ExitOnError)
+	name := flags.String("c", "", "collection: "+dataCollectionNames())
+	out := flags.String("o", "-", "output file (ndjson), - for stdout")
+	filter := flags.String("filter", "", "mongodb query in json, e.g. {\"app_id\":123}")
+	resume := flags.Bool("resume", false, "continue an interrupted export into -o")
+	mongoURL := flags.String("mongo", defaultMongoURL(), "mongodb connection string")
+	flags.Parse(args)
+
+	coll, ok := dataCollections[*name]
+	if !ok {
+		flags.Usage()
+		return fmt.Errorf("-c must be one of: %s", dataCollectionNames())
+	}
+	if *resume && *out == "-" {
+		return fmt.Errorf("-resume needs -o file")
+	}
+
+	query, err := parseFilter(*filter)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if *resume {
+			mode = os.O_RDWR | os.O_CREATE
+		}
+		w, err = os.OpenFile(*out, mode, 0644)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	if *resume {
+		line, err := lastLine(w)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *out, err)
+		}
+		if line != nil {
+			last, err := decodeDocument(line)
+			if err != nil {
+				return fmt.Errorf("%s: last line: %v", *out, err)
+			}
+			query = bson.M{"$and": []bson.M{query, afterKey(coll.Keys, last)}}
+			fmt.Fprintf(os.Stderr, "resuming after %v\n", keyString(coll.Keys, last))
+		}
+	}
+
+	session, err := dial(*mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	buf := bufio.NewWriter(w)
+	count := 0
+	iter := session.DB("simple").C(*name).Find(query).Sort(coll.Keys...).Select(bson.M{"_id": 0}).Iter()
+	var doc bson.M
+	for iter.Next(&doc) {
+		line, err := json.Marshal(doc)
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("%v: %v", keyString(coll.Keys, doc), err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		count++
+		doc = nil
+	}
+	err = iter.Close()
+	if flushErr := buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return fmt.Errorf("export %s after %d documents: %v", *name, count, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d documents from %s\n", count, *name)
+	return nil
+}
+
+// Статистика загрузки
+type importStats struct {
+	Read     int
+	Inserted int
+	Updated  int
+	Existing int //пропущены, уже есть в базе (режим skip)
+	Filtered int //не подошли под -filter
+}
+
+// matchFilter - для загрузки фильтр проверяется без базы, поэтому
+// поддерживается только равенство полей верхнего уровня
+func matchFilter(filter bson.M, doc bson.M) bool {
+	for key, want := range filter {
+		if fmt.Sprint(doc[key]) != fmt.Sprint(want) {
+			return false
+		}
+	}
+	return true
+}
+
+func dataImport(args []string) error {
+	flags := flag.NewFlagSet("data import", flag.ExitOnError)
+	name := flags.String("c", "", "collection: "+dataCollectionNames())
+	path := flags.String("f", "", "input file (ndjson)")
+	mode := flags.String("mode", importSkip, "skip - keep existing documents, upsert - replace them")
+	filter := flags.String("filter", "", "import only documents with these field values, e.g. {\"app_id\":123}")
+	resume := flags.Bool("resume", false, "continue an interrupted import from the saved position")
+	dryRun := flags.Bool("dry-run", false, "validate the file without writing")
+	mongoURL := flags.String("mongo", defaultMongoURL(), "mongodb connection string")
+	flags.Parse(args)
+
+	coll, ok := dataCollections[*name]
+	if !ok {
+		flags.Usage()
+		return fmt.Errorf("-c must be one of: %s", dataCollectionNames())
+	}
+	if *path == "" {
+		flags.Usage()
+		return fmt.Errorf("-f is required")
+	}
+	if *mode != importSkip && *mode != importUpsert {
+		return fmt.Errorf("-mode must be %s or %s", importSkip, importUpsert)
+	}
+
+	match, err := parseFilter(*filter)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Позиция загрузки - число обработанных строк, сохраняется рядом с файлом
+	offsetPath := *path + ".offset"
+	skip := 0
+	if *resume {
+		data, err := ioutil.ReadFile(offsetPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			skip, err = strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				return fmt.Errorf("%s: %v", offsetPath, err)
+			}
+			fmt.Fprintf(os.Stderr, "resuming after line %d\n", skip)
+		}
+	}
+
+	var c *mgo.Collection
+	if !*dryRun {
+		session, err := dial(*mongoURL)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		c = session.DB("simple").C(*name)
+	}
+
+	var stats importStats
+	lineNo := 0
+	saveOffset := func() {
+		if !*dryRun {
+			ioutil.WriteFile(offsetPath, []byte(strconv.Itoa(lineNo)), 0644)
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if lineNo < skip {
+			lineNo++
+			continue
+		}
+		if len(line) == 0 {
+			lineNo++
+			continue
+		}
+		stats.Read++
+
+		doc, key, err := coll.Parse(line)
+		if err != nil {
+			saveOffset()
+			return fmt.Errorf("%s:%d: %v", *path, lineNo+1, err)
+		}
+		if len(match) > 0 {
+			raw, _ := decodeDocument(line)
+			if !matchFilter(match, raw) {
+				stats.Filtered++
+				lineNo++
+				continue
+			}
+		}
+
+		if !*dryRun {
+			err = importDocument(c, *mode, doc, key, &stats)
+			if err != nil {
+				saveOffset()
+				return fmt.Errorf("%s:%d: %v: %v", *path, lineNo+1, keyString(coll.Keys, key), err)
+			}
+		}
+
+		lineNo++
+		if lineNo%1000 == 0 {
+			saveOffset()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		saveOffset()
+		return fmt.Errorf("%s:%d: %v", *path, lineNo+1, err)
+	}
+	os.Remove(offsetPath)
+
+	if *dryRun {
+		fmt.Printf("dry run: %d documents are valid\n", stats.Read-stats.Filtered)
+		return nil
+	}
+	fmt.Printf("read %d, inserted %d, updated %d, existing %d, filtered %d\n",
+		stats.Read, stats.Inserted, stats.Updated, stats.Existing, stats.Filtered)
+	return nil
+}
+
+func importDocument(c *mgo.Collection, mode string, doc interface{}, key bson.M, stats *importStats) error {
+	if mode == importUpsert {
+		info, err := c.Upsert(key, doc)
+		if err != nil {
+			return err
+		}
+		if info.UpsertedId != nil {
+			stats.Inserted++
+		} else {
+			stats.Updated++
+		}
+		return nil
+	}
+
+	count, err := c.Find(key).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		stats.Existing++
+		return nil
+	}
+	err = c.Insert(doc)
+	if mgo.IsDup(err) {
+		stats.Existing++
+		return nil
+	}
+	if err == nil {
+		stats.Inserted++
+	}
+	return err
+}
+
+func keyString(keys []string, doc bson.M) string {
+	parts := []string{}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", key, doc[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func dataCollectionNames() string {
+	names := []string{}
+	for name := range dataCollections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
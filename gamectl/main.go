@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/mgo.v2"
+)
+
+// gamectl - утилита администрирования базы игр
+//
+//	gamectl catalog apply -f items.yaml [-dry-run]
+//	gamectl pay reconcile -f vk_orders.csv [-json]
+//	gamectl data export -c users_arrows -o users.ndjson [-filter json] [-resume]
+//	gamectl data import -c users_arrows -f users.ndjson [-mode skip|upsert] [-resume]
+//	gamectl backup run -to /backups|s3://bucket/prefix [-every 24h] [-keep-daily 7]
+//	gamectl backup restore -from /backups [-id latest] -c collection | -user id
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  gamectl catalog apply -f items.yaml [-dry-run] [-mongo url]")
+	fmt.Fprintln(os.Stderr, "  gamectl pay reconcile -f vk_orders.csv|json [-format csv|json] [-sep ;] [-json] [-mongo url]")
+	fmt.Fprintln(os.Stderr, "  gamectl data export -c users_arrows|pay|showcase [-o file.ndjson] [-filter json] [-resume] [-mongo url]")
+	fmt.Fprintln(os.Stderr, "  gamectl data import -c users_arrows|pay|showcase -f file.ndjson [-mode skip|upsert] [-filter json] [-resume] [-dry-run] [-mongo url]")
+	fmt.Fprintln(os.Stderr, "  gamectl backup run -to dir|s3://bucket/prefix [-c collections] [-every 24h] [-keep-last N] [-keep-daily N] [-keep-weekly N] [-keep-monthly N] [-mongo url]")
+	fmt.Fprintln(os.Stderr, "  gamectl backup list -to dir|s3://bucket/prefix")
+	fmt.Fprintln(os.Stderr, "  gamectl backup prune -to dir|s3://bucket/prefix [-keep-last N] [-keep-daily N] [-keep-weekly N] [-keep-monthly N]")
+	fmt.Fprintln(os.Stderr, "  gamectl backup restore -from dir|s3://bucket/prefix [-id latest] [-c collection] [-user id] [-mode upsert|skip|replace] [-dry-run] [-mongo url]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] + " " + os.Args[2] {
+	case "catalog apply":
+		err = catalogApply(os.Args[3:])
+	case "pay reconcile":
+		err = payReconcile(os.Args[3:])
+	case "data export":
+		err = dataExport(os.Args[3:])
+	case "data import":
+		err = dataImport(os.Args[3:])
+	case "backup run":
+		err = backupRun(os.Args[3:])
+	case "backup list":
+		err = backupList(os.Args[3:])
+	case "backup prune":
+		err = backupPrune(os.Args[3:])
+	case "backup restore":
+		err = backupRestore(os.Args[3:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func defaultMongoURL() string {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		url = "mongodb://172.17.0.1:27017/simple"
+	}
+	return url
+}
+
+func dial(url string) (*mgo.Session, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s: %v", url, err)
+	}
+	session.SetMode(mgo.Monotonic, true)
+	return session, nil
+}
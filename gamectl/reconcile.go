@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const payCollection = "pay"
+
+// Заказ из выгрузки VK
+type vkOrder struct {
+	Order_id int
+	App_id   int
+	User_id  int
+	Item     string
+	Amount   int //Сумма в голосах
+	Date     int64
+	Status   string
+	Line     int //Строка в файле, для отчета
+}
+
+// Статусы заказа в выгрузке VK, сведенные к трем
+const (
+	vkPaid     = "paid"     //голоса списаны
+	vkRefunded = "refunded" //голоса возвращены игроку
+	vkDeclined = "declined" //оплата не прошла, голоса не списаны
+)
+
+// statusKind сводит статус из выгрузки к vkPaid, vkRefunded или vkDeclined.
+// Выгрузки без колонки статуса содержат только оплаченные заказы.
+func (o vkOrder) statusKind() string {
+	switch strings.ToLower(o.Status) {
+	case "refunded", "refund", "возврат", "возвращен":
+		return vkRefunded
+	case "declined", "canceled", "cancelled", "failed", "отменен", "отклонен":
+		return vkDeclined
+	}
+	return vkPaid
+}
+
+// Заказ из коллекции pay, только нужные для сверки поля
+type payOrder struct {
+	App_order_id int    `bson:"app_order_id"`
+	App_id       int    `bson:"app_id"`
+	User_id      int    `bson:"user_id"`
+	Order_id     int    `bson:"order_id"`
+	Date         int    `bson:"date"`
+	Item         string `bson:"item"`
+	Item_price   string `bson:"item_price"`
+	Amount       int    `bson:"amount"` //Сколько списал VK, у старых заказов нет
+	State        string `bson:"state"`
+}
+
+// price - сумма заказа в голосах: amount, который pay записывает после
+// проверки цены, а у заказов, сохраненных до его появления, - item_price
+func (o payOrder) price() int {
+	if o.Amount > 0 {
+		return o.Amount
+	}
+	price, _ := strconv.Atoi(o.Item_price)
+	return price
+}
+
+// refunded - возврат принят pay (или еще выполняется)
+func (o payOrder) refunded() bool {
+	return o.State == "refunded" || o.State == "refunding"
+}
+
+// Виды расхождений
+const (
+	issueMissingDB   = "missing_in_db"   //VK списал голоса, заказа у нас нет
+	issueMissingVK   = "missing_in_vk"   //заказ у нас есть, в выгрузке VK его нет
+	issueDuplicateVK = "duplicate_vk"    //order_id повторяется в выгрузке
+	issueDuplicateDB = "duplicate_db"    //order_id повторяется в pay
+	issueAmount      = "amount_mismatch" //суммы в VK и у нас разные
+	issueNotGranted  = "not_granted"     //оплачен, но покупка не выдана
+	issueRefund      = "refund_mismatch" //возврат есть только с одной стороны
+	issueDeclined    = "declined_in_vk"  //VK не списал голоса, а заказ у нас есть
+)
+
+type reconcileIssue struct {
+	Kind     string `json:"kind"`
+	Order_id int    `json:"order_id"`
+	App_id   int    `json:"app_id"`
+	Day      string `json:"day"`
+	Detail   string `json:"detail"`
+}
+
+// Итоги за день по приложению. Количество и сумма - по оплаченным и не
+// возвращенным заказам, возвраты считаются отдельно.
+type reconcileSummary struct {
+	Day         string         `json:"day"`
+	App_id      int            `json:"app_id"`
+	VK_count    int            `json:"vk_count"`
+	VK_amount   int            `json:"vk_amount"`
+	VK_refunded int            `json:"vk_refunded"`
+	DB_count    int            `json:"db_count"`
+	DB_amount   int            `json:"db_amount"`
+	DB_refunded int            `json:"db_refunded"`
+	Issues      map[string]int `json:"issues"`
+}
+
+type reconcileReport struct {
+	Issues  []reconcileIssue   `json:"issues"`
+	Summary []reconcileSummary `json:"summary"`
+}
+
+// Названия колонок в выгрузках VK отличаются, поэтому для каждого поля
+// перечислены варианты
+var vkColumns = map[string][]string{
+	"order_id": {"order_id", "id", "order"},
+	"app_id":   {"app_id", "app"},
+	"user_id":  {"user_id", "user", "uid"},
+	"item":     {"item", "item_id", "product"},
+	"amount":   {"amount", "item_price", "price", "votes", "sum"},
+	"date":     {"date", "created", "time", "datetime"},
+	"status":   {"status", "state"},
+}
+
+func parseVKDate(val string) (int64, error) {
+	val = strings.TrimSpace(val)
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return n, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "02.01.2006 15:04:05", "2006-01-02", "02.01.2006"} {
+		t, err := time.ParseInLocation(layout, val, time.Local)
+		if err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown date format %q", val)
+}
+
+// vkOrderFromFields собирает заказ из полей одной записи выгрузки
+func vkOrderFromFields(get func(field string) string, line int) (vkOrder, error) {
+	order := vkOrder{Line: line, Item: get("item"), Status: get("status")}
+
+	var err error
+	order.Order_id, err = strconv.Atoi(get("order_id"))
+	if err != nil {
+		return order, fmt.Errorf("line %d: bad order_id %q", line, get("order_id"))
+	}
+	order.App_id, _ = strconv.Atoi(get("app_id"))
+	order.User_id, _ = strconv.Atoi(get("user_id"))
+	amount, err := strconv.ParseFloat(strings.Replace(get("amount"), ",", ".", 1), 64)
+	if err != nil {
+		return order, fmt.Errorf("line %d: bad amount %q", line, get("amount"))
+	}
+	order.Amount = int(amount + 0.5)
+	order.Date, err = parseVKDate(get("date"))
+	if err != nil {
+		return order, fmt.Errorf("line %d: %v", line, err)
+	}
+	return order, nil
+}
+
+func loadVKOrdersCSV(data string, sep string) ([]vkOrder, error) {
+	// Excel сохраняет CSV с точкой с запятой
+	if sep == "" {
+		sep = ","
+		head := strings.SplitN(data, "\n", 2)[0]
+		if strings.Count(head, ";") > strings.Count(head, ",") {
+			sep = ";"
+		}
+	}
+
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.Comma = []rune(sep)[0]
+	reader.FieldsPerRecord = -1
+	head, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+
+	index := map[string]int{}
+	for i, name := range head {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for field, names := range vkColumns {
+			for _, it := range names {
+				if _, ok := index[field]; !ok && name == it {
+					index[field] = i
+				}
+			}
+		}
+	}
+	for _, field := range []string{"order_id", "amount", "date"} {
+		if _, ok := index[field]; !ok {
+			return nil, fmt.Errorf("column %s not found in header %v", field, head)
+		}
+	}
+
+	var orders []vkOrder
+	for line := 2; ; line++ {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(field string) string {
+			i, ok := index[field]
+			if !ok || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+		order, err := vkOrderFromFields(get, line)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func loadVKOrdersJSON(data string) ([]vkOrder, error) {
+	var raw []map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("expected json array of orders: %v", err)
+	}
+
+	var orders []vkOrder
+	for i, rec := range raw {
+		get := func(field string) string {
+			for _, name := range vkColumns[field] {
+				if val, ok := rec[name]; ok && val != nil {
+					return strings.TrimSpace(fmt.Sprint(val))
+				}
+			}
+			return ""
+		}
+		order, err := vkOrderFromFields(get, i+1)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func loadVKOrders(path string, format string, sep string) ([]vkOrder, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case "csv":
+		return loadVKOrdersCSV(string(data), sep)
+	case "json":
+		return loadVKOrdersJSON(string(data))
+	}
+	return nil, fmt.Errorf("unknown export format %q, use -format csv or json", format)
+}
+
+func dayOf(date int64) string {
+	return time.Unix(date, 0).Format("2006-01-02")
+}
+
+// reconcile сверяет выгрузку VK с заказами из pay. Заказы pay должны быть уже
+// отобраны по периоду и приложениям выгрузки.
+func reconcile(vk []vkOrder, db []payOrder) reconcileReport {
+	var report reconcileReport
+
+	type sumKey struct {
+		Day    string
+		App_id int
+	}
+	sums := map[sumKey]*reconcileSummary{}
+	sum := func(day string, app_id int) *reconcileSummary {
+		k := sumKey{day, app_id}
+		if sums[k] == nil {
+			sums[k] = &reconcileSummary{Day: day, App_id: app_id, Issues: map[string]int{}}
+		}
+		return sums[k]
+	}
+	issue := func(kind string, order_id int, app_id int, day string, detail string) {
+		report.Issues = append(report.Issues, reconcileIssue{kind, order_id, app_id, day, detail})
+		sum(day, app_id).Issues[kind]++
+	}
+
+	vkByID := map[int]vkOrder{}
+	for _, it := range vk {
+		day := dayOf(it.Date)
+		if prev, ok := vkByID[it.Order_id]; ok {
+			issue(issueDuplicateVK, it.Order_id, it.App_id, day, fmt.Sprintf("lines %d and %d", prev.Line, it.Line))
+			continue
+		}
+		vkByID[it.Order_id] = it
+		s := sum(day, it.App_id)
+		switch it.statusKind() {
+		case vkPaid:
+			s.VK_count++
+			s.VK_amount += it.Amount
+		case vkRefunded:
+			s.VK_refunded++
+		}
+	}
+
+	dbByID := map[int]payOrder{}
+	for _, it := range db {
+		day := dayOf(int64(it.Date))
+		if prev, ok := dbByID[it.Order_id]; ok {
+			issue(issueDuplicateDB, it.Order_id, it.App_id, day, fmt.Sprintf("app_order_id %d and %d", prev.App_order_id, it.App_order_id))
+			continue
+		}
+		dbByID[it.Order_id] = it
+		price := it.price()
+		s := sum(day, it.App_id)
+		if it.refunded() {
+			s.DB_refunded++
+		} else {
+			s.DB_count++
+			s.DB_amount += price
+		}
+
+		v, ok := vkByID[it.Order_id]
+		if !ok {
+			issue(issueMissingVK, it.Order_id, it.App_id, day, fmt.Sprintf("app_order_id %d item %s", it.App_order_id, it.Item))
+			continue
+		}
+
+		status := v.statusKind()
+		if status == vkDeclined {
+			issue(issueDeclined, it.Order_id, it.App_id, day, fmt.Sprintf("app_order_id %d status %s state %s", it.App_order_id, v.Status, it.State))
+			continue
+		}
+		if v.Amount != price {
+			issue(issueAmount, it.Order_id, it.App_id, day, fmt.Sprintf("vk %d, pay %d", v.Amount, price))
+		}
+		if (status == vkRefunded) != it.refunded() {
+			issue(issueRefund, it.Order_id, it.App_id, day, fmt.Sprintf("app_order_id %d status %s state %s", it.App_order_id, v.Status, it.State))
+			continue
+		}
+		// Заказы до появления состояний (state пустой) выдавались сразу
+		if status == vkPaid && it.State != "" && it.State != "granted" {
+			issue(issueNotGranted, it.Order_id, it.App_id, day, fmt.Sprintf("app_order_id %d state %s", it.App_order_id, it.State))
+		}
+	}
+
+	// Отклоненные и возвращенные заказы, которых нет в pay, ничего не стоили игроку
+	for _, it := range vk {
+		if it.statusKind() != vkPaid {
+			continue
+		}
+		if _, ok := dbByID[it.Order_id]; !ok && vkByID[it.Order_id].Line == it.Line {
+			issue(issueMissingDB, it.Order_id, it.App_id, dayOf(it.Date), fmt.Sprintf("line %d user %d item %s amount %d", it.Line, it.User_id, it.Item, it.Amount))
+		}
+	}
+
+	for _, s := range sums {
+		report.Summary = append(report.Summary, *s)
+	}
+	sort.Slice(report.Summary, func(i, j int) bool {
+		a, b := report.Summary[i], report.Summary[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return a.App_id < b.App_id
+	})
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return a.Order_id < b.Order_id
+	})
+	return report
+}
+
+var issueKinds = []string{issueMissingDB, issueMissingVK, issueDuplicateVK, issueDuplicateDB, issueAmount, issueNotGranted, issueRefund, issueDeclined}
+
+func printReport(w io.Writer, report reconcileReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	if len(report.Issues) > 0 {
+		fmt.Fprintln(tw, "KIND\tORDER_ID\tAPP_ID\tDAY\tDETAIL")
+		for _, it := range report.Issues {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", it.Kind, it.Order_id, it.App_id, it.Day, it.Detail)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	fmt.Fprint(tw, "DAY\tAPP_ID\tVK_COUNT\tVK_AMOUNT\tVK_REFUNDED\tPAY_COUNT\tPAY_AMOUNT\tPAY_REFUNDED")
+	for _, kind := range issueKinds {
+		fmt.Fprint(tw, "\t"+strings.ToUpper(kind))
+	}
+	fmt.Fprintln(tw)
+	for _, s := range report.Summary {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d", s.Day, s.App_id, s.VK_count, s.VK_amount, s.VK_refunded, s.DB_count, s.DB_amount, s.DB_refunded)
+		for _, kind := range issueKinds {
+			fmt.Fprintf(tw, "\t%d", s.Issues[kind])
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d issues\n", len(report.Issues))
+}
+
+func payReconcile(args []string) error {
+	flags := flag.NewFlagSet("pay reconcile", flag.ExitOnError)
+	path := flags.String("f", "", "VK orders export (csv or json)")
+	format := flags.String("format", "", "export format: csv or json (by file extension if empty)")
+	sep := flags.String("sep", "", "csv field separator (by header if empty)")
+	asJSON := flags.Bool("json", false, "print report as json")
+	mongoURL := flags.String("mongo", defaultMongoURL(), "mongodb connection string")
+	flags.Parse(args)
+
+	if *path == "" {
+		flags.Usage()
+		return fmt.Errorf("-f is required")
+	}
+
+	vk, err := loadVKOrders(*path, *format, *sep)
+	if err != nil {
+		return err
+	}
+	if len(vk) == 0 {
+		return fmt.Errorf("no orders in %s", *path)
+	}
+
+	// Сверяем заказы pay только за период выгрузки (по дням целиком)
+	// и только по приложениям, которые в ней есть
+	from, to := vk[0].Date, vk[0].Date
+	apps := map[int]bool{}
+	for _, it := range vk {
+		if it.Date < from {
+			from = it.Date
+		}
+		if it.Date > to {
+			to = it.Date
+		}
+		apps[it.App_id] = true
+	}
+	start, _ := time.ParseInLocation("2006-01-02", dayOf(from), time.Local)
+	end, _ := time.ParseInLocation("2006-01-02", dayOf(to), time.Local)
+	end = end.AddDate(0, 0, 1)
+
+	query := bson.M{"date": bson.M{"$gte": start.Unix(), "$lt": end.Unix()}}
+	if !apps[0] {
+		app_ids := []int{}
+		for app_id := range apps {
+			app_ids = append(app_ids, app_id)
+		}
+		query["app_id"] = bson.M{"$in": app_ids}
+	}
+
+	session, err := dial(*mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var db []payOrder
+	err = session.DB("simple").C(payCollection).Find(query).Sort("app_order_id").All(&db)
+	if err != nil {
+		return fmt.Errorf("read pay: %v", err)
+	}
+
+	report := reconcile(vk, db)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printReport(os.Stdout, report)
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Хранилище копий: каталог на диске или бакет S3 (MinIO и т.п.).
+// Файлы копий бывают большими, поэтому читаются и пишутся потоком.
+type backupStore interface {
+	Put(name string, data io.ReadSeeker) error
+	Get(name string) (io.ReadCloser, error)
+	List(prefix string) ([]string, error) //имена файлов относительно хранилища
+	Delete(name string) error
+}
+
+// openStore открывает хранилище по адресу: путь к каталогу или
+// s3://bucket/prefix. Для S3 адрес сервера и ключи берутся из
+// S3_ENDPOINT, S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION.
+func openStore(location string) (backupStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		dir := strings.TrimPrefix(location, "file://")
+		if dir == "" {
+			return nil, fmt.Errorf("backup location is required")
+		}
+		return localStore{dir}, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	store := &s3Store{
+		Endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		Region:    os.Getenv("S3_REGION"),
+		// Без общего таймаута: большая копия может передаваться дольше
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 5 * time.Minute,
+		}},
+	}
+	if store.Endpoint == "" {
+		store.Endpoint = "https://s3.amazonaws.com"
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.Bucket == "" || store.AccessKey == "" || store.SecretKey == "" {
+		return nil, fmt.Errorf("%s: bucket, S3_ACCESS_KEY and S3_SECRET_KEY are required", location)
+	}
+	return store, nil
+}
+
+type localStore struct {
+	Dir string
+}
+
+func (s localStore) Put(name string, data io.ReadSeeker) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// Через временный файл, чтобы оборванная запись не выглядела целой
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s localStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, filepath.FromSlash(name)))
+}
+
+func (s localStore) List(prefix string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err == nil && strings.HasPrefix(filepath.ToSlash(rel), prefix) {
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+func (s localStore) Delete(name string) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	err := os.Remove(path)
+	if err == nil {
+		// Пустой каталог копии больше не нужен
+		os.Remove(filepath.Dir(path))
+	}
+	return err
+}
+
+// s3Store - минимальный клиент S3 (path-style запросы с подписью AWS v4),
+// достаточный для копий: положить, прочитать, перечислить и удалить объект
+type s3Store struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	client    *http.Client
+}
+
+func (s *s3Store) key(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return s.Prefix + "/" + name
+}
+
+func (s *s3Store) Put(name string, data io.ReadSeeker) error {
+	body, err := s.do("PUT", s.key(name), nil, data)
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func (s *s3Store) Get(name string) (io.ReadCloser, error) {
+	return s.do("GET", s.key(name), nil, nil)
+}
+
+func (s *s3Store) Delete(name string) error {
+	body, err := s.do("DELETE", s.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	var result struct {
+		Contents []struct {
+			Key string
+		}
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+
+	names := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Contents, result.IsTruncated = nil, false
+		err = xml.NewDecoder(body).Decode(&result)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %v", s.Bucket, err)
+		}
+		for _, it := range result.Contents {
+			name := it.Key
+			if s.Prefix != "" {
+				name = strings.TrimPrefix(name, s.Prefix+"/")
+			}
+			names = append(names, name)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// uriEncode - кодирование по правилам подписи AWS (RFC 3986, пробел - %20)
+func uriEncode(val string, path bool) string {
+	encoded := strings.ReplaceAll(url.QueryEscape(val), "+", "%20")
+	if path {
+		encoded = strings.ReplaceAll(encoded, "%2F", "/")
+	}
+	return encoded
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign подписывает запрос (AWS Signature Version 4, заголовки host, x-amz-content-sha256, x-amz-date)
+func (s *s3Store) sign(req *http.Request, path string, rawQuery string, payload string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	headers := "host:" + req.URL.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + amzDate + "\n"
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{req.Method, path, rawQuery, headers, signed, payload}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+}
+
+// do выполняет запрос. Тело запроса читается дважды: для подписи по
+// sha256 и для отправки. Тело ответа закрывает вызывающий.
+func (s *s3Store) do(method string, key string, query url.Values, body io.ReadSeeker) (io.ReadCloser, error) {
+	path := "/" + uriEncode(s.Bucket, false)
+	if key != "" {
+		path += "/" + uriEncode(key, true)
+	}
+
+	params := []string{}
+	for name, values := range query {
+		for _, val := range values {
+			params = append(params, uriEncode(name, false)+"="+uriEncode(val, false))
+		}
+	}
+	sort.Strings(params)
+	rawQuery := strings.Join(params, "&")
+
+	target := s.Endpoint + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	payloadHash := sha256.New()
+	size, err := io.Copy(payloadHash, body)
+	if err != nil {
+		return nil, err
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, target, ioutil.NopCloser(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	s.sign(req, path, rawQuery, hex.EncodeToString(payloadHash.Sum(nil)), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp.Body, nil
+	}
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// achievementsHook просит simple проверить достижения игрока после выдачи
+// покупки. Запрос идет в фоне: ответ VK не ждет simple, а ошибка только
+// пишется в лог - достижение откроется при следующем обновлении игрока.
+func achievementsHook(cfg Config, r *http.Request, vk_id int) {
+	if cfg.SimpleURL == "" {
+		return
+	}
+
+	id := requestID(r)
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	url := strings.TrimRight(cfg.SimpleURL, "/") + "/admin/users/" + strconv.Itoa(vk_id) + "/achievements/check"
+
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+		if err != nil {
+			logger.Error("achievements hook", "request_id", id, "err", err)
+			return
+		}
+		req.Header.Set("X-Admin-Token", cfg.SimpleToken)
+		req.Header.Set("X-Request-Id", id)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			logger.Warn("achievements hook", "request_id", id, "user_id", vk_id, "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			logger.Warn("achievements hook", "request_id", id, "user_id", vk_id, "status", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+var errForbidden = &apiError{http.StatusForbidden, "forbidden", "forbidden"}
+
+// adminOnly пускает только запросы с заголовком X-Admin-Token из конфига.
+// Если токен не задан, админские маршруты выключены.
+func adminOnly(cfg Config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Admin-Token")
+		if cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			reqLog(r).Warn("admin access denied", "path", r.URL.Path)
+			errorWithJSON(w, r, errForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
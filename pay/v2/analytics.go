@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Аналитика продаж считается только по боевым заказам: заказы
+// песочницы (pay_test) и возвращенные деньги (refunded) в выручку не входят.
+
+var errAnalyticsParams = &apiError{http.StatusBadRequest, "error_params", "period must be day, week or month; by - item, app_id, first or empty; from/to - YYYY-MM-DD"}
+
+// Строка отчета: выручка за период в разрезе Key
+type revenueRow struct {
+	Period  string  `json:"period"`  //2026-10-01, 2026-W40 или 2026-10
+	Key     string  `json:"key"`     //товар, app_id, first/repeat или пусто
+	Revenue int     `json:"revenue"` //Голоса
+	Orders  int     `json:"orders"`  //В разрезе item части набора считаются отдельно
+	Payers  int     `json:"payers"`  //Разных плательщиков за период
+	ARPPU   float64 `json:"arppu"`   //Выручка на одного плательщика
+}
+
+// markFirstPurchase отмечает первую покупку плательщика в приложении
+func markFirstPurchase(r *http.Request, c *mgo.Collection, order *Order) error {
+	var count int
+	err := traceDB(r, "count", c.Name, func() (err error) {
+		count, err = c.Find(bson.M{"user_id": order.User_id, "app_id": order.App_id}).Count()
+		return err
+	})
+	order.First = err == nil && count == 0
+	return err
+}
+
+func ensureIndexAnalytics(session *mgo.Session) {
+	c := session.DB("simple").C(liveEnv.Orders)
+	for _, key := range [][]string{{"date"}, {"user_id", "app_id"}} {
+		index := mgo.Index{
+			Key:        key,
+			Background: true,
+		}
+		err := c.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// backfillAnalytics заполняет amount и first в заказах, сохраненных до
+// появления аналитики
+func backfillAnalytics(s *mgo.Session) {
+	session := s.Copy()
+	defer session.Close()
+
+	c := session.DB("simple").C(liveEnv.Orders)
+	missing := bson.M{"$or": []bson.M{{"amount": bson.M{"$exists": false}}, {"first": bson.M{"$exists": false}}}}
+	count, err := c.Find(missing).Count()
+	if err != nil || count == 0 {
+		return
+	}
+	logger.Info("analytics backfill", "orders", count)
+
+	type payer struct {
+		User_id int
+		App_id  int
+	}
+	seen := map[payer]bool{}
+
+	// Указатели отличают отсутствующее поле от нулевого значения
+	var order struct {
+		App_order_id int
+		User_id      int
+		App_id       int
+		Item_price   string
+		Amount       *int
+		First        *bool
+	}
+	iter := c.Find(nil).Sort("app_order_id").Select(bson.M{"app_order_id": 1, "user_id": 1, "app_id": 1, "item_price": 1, "amount": 1, "first": 1}).Iter()
+	for iter.Next(&order) {
+		p := payer{order.User_id, order.App_id}
+		set := bson.M{}
+		if order.Amount == nil {
+			set["amount"], _ = strconv.Atoi(order.Item_price)
+		}
+		if order.First == nil {
+			set["first"] = !seen[p]
+		}
+		seen[p] = true
+
+		if len(set) > 0 {
+			err = c.Update(bson.M{"app_order_id": order.App_order_id}, bson.M{"$set": set})
+			if err != nil {
+				logger.Error("analytics backfill", "app_order_id", order.App_order_id, "err", err)
+			}
+		}
+		order.Amount, order.First = nil, nil
+	}
+	err = iter.Close()
+	if err != nil {
+		logger.Error("analytics backfill", "err", err)
+	}
+}
+
+// periodOf - название периода для дня day (полночь по времени отчета,
+// записанная как время UTC)
+func periodOf(day int64, period string) string {
+	t := time.Unix(day, 0).UTC()
+	switch period {
+	case "week":
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	case "month":
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// revenueReport считает выручку за [from, to). Mongo группирует заказы по дню,
+// плательщику и разрезу, а сюда приходят уже свернутые строки: из них
+// собираются недели и месяцы и считаются уникальные плательщики.
+func revenueReport(r *http.Request, c *mgo.Collection, cfg Config, from time.Time, to time.Time, app_id int, period string, by string) ([]revenueRow, error) {
+	offset := cfg.ReportUTCOffset * 3600
+	match := bson.M{"date": bson.M{"$gte": from.Unix(), "$lt": to.Unix()}, "state": bson.M{"$ne": orderRefunded}}
+	if app_id != 0 {
+		match["app_id"] = app_id
+	}
+	local := bson.M{"$add": []interface{}{"$date", offset}}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$project": bson.M{
+			"user_id": 1,
+			"app_id":  1,
+			"first":   1,
+			"amount":  1,
+			// Заказы до наборов хранят только item
+			"parts": bson.M{"$ifNull": []interface{}{"$parts", []bson.M{{"item": "$item", "count": 1, "price": "$amount"}}}},
+			"day":   bson.M{"$subtract": []interface{}{local, bson.M{"$mod": []interface{}{local, 86400}}}},
+		}},
+	}
+
+	var key interface{}
+	revenue := "$amount"
+	switch by {
+	case "item":
+		// Набор раскладывается на части, каждая со своей долей цены
+		pipeline = append(pipeline, bson.M{"$unwind": "$parts"})
+		key, revenue = "$parts.item", "$parts.price"
+	case "app_id":
+		key = "$app_id"
+	case "first":
+		key = "$first"
+	}
+
+	pipeline = append(pipeline, bson.M{"$group": bson.M{
+		"_id":     bson.M{"day": "$day", "user": "$user_id", "key": key},
+		"revenue": bson.M{"$sum": revenue},
+		"orders":  bson.M{"$sum": 1},
+	}})
+
+	var result []struct {
+		ID struct {
+			Day  int64       `bson:"day"`
+			User int         `bson:"user"`
+			Key  interface{} `bson:"key"`
+		} `bson:"_id"`
+		Revenue int `bson:"revenue"`
+		Orders  int `bson:"orders"`
+	}
+	err := traceDB(r, "aggregate", c.Name, func() error {
+		return c.Pipe(pipeline).AllowDiskUse().All(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type rowKey struct {
+		Period string
+		Key    string
+	}
+	rows := map[rowKey]*revenueRow{}
+	payers := map[rowKey]map[int]bool{}
+	payersRevenue := map[rowKey]int{}
+	for _, it := range result {
+		k := rowKey{periodOf(it.ID.Day, period), ""}
+		switch v := it.ID.Key.(type) {
+		case nil:
+		case bool:
+			k.Key = "repeat"
+			if v {
+				k.Key = "first"
+			}
+		default:
+			k.Key = fmt.Sprint(v)
+		}
+
+		row := rows[k]
+		if row == nil {
+			row = &revenueRow{Period: k.Period, Key: k.Key}
+			rows[k] = row
+			payers[k] = map[int]bool{}
+		}
+		row.Revenue += it.Revenue
+		row.Orders += it.Orders
+		// После удаления игрока его заказы обезличены (user_id 0): в выручке
+		// они остаются, а в плательщиках и ARPPU не учитываются, иначе все
+		// удаленные плательщики считались бы одним
+		if it.ID.User != 0 {
+			payers[k][it.ID.User] = true
+			payersRevenue[k] += it.Revenue
+		}
+	}
+
+	report := []revenueRow{}
+	for k, row := range rows {
+		row.Payers = len(payers[k])
+		if row.Payers > 0 {
+			row.ARPPU = float64(int(float64(payersRevenue[k])/float64(row.Payers)*100+0.5)) / 100
+		}
+		report = append(report, *row)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Period != report[j].Period {
+			return report[i].Period < report[j].Period
+		}
+		return report[i].Key < report[j].Key
+	})
+	return report, nil
+}
+
+func revenueCSV(report []revenueRow) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"period", "key", "revenue", "orders", "payers", "arppu"})
+	for _, it := range report {
+		w.Write([]string{it.Period, it.Key, strconv.Itoa(it.Revenue), strconv.Itoa(it.Orders), strconv.Itoa(it.Payers), strconv.FormatFloat(it.ARPPU, 'f', 2, 64)})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// revenueHandler - выручка, количество заказов, плательщики и ARPPU.
+// Параметры: period (day, week, month), by (item, app_id, first или пусто),
+// from и to (YYYY-MM-DD включительно, по умолчанию последние 30 дней),
+// app_id, format=csv.
+func revenueHandler(cfg Config, s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		q := r.URL.Query()
+		period := q.Get("period")
+		if period == "" {
+			period = "day"
+		}
+		by := q.Get("by")
+		if (period != "day" && period != "week" && period != "month") ||
+			(by != "" && by != "item" && by != "app_id" && by != "first") {
+			errorWithJSON(w, r, errAnalyticsParams)
+			return
+		}
+
+		// Границы дней по времени отчета
+		zone := time.FixedZone("report", cfg.ReportUTCOffset*3600)
+		today := startOfDay(time.Now().In(zone))
+		from, to := today.AddDate(0, 0, -29), today
+		var err error
+		if v := q.Get("from"); v != "" {
+			from, err = time.ParseInLocation("2006-01-02", v, zone)
+		}
+		if v := q.Get("to"); v != "" && err == nil {
+			to, err = time.ParseInLocation("2006-01-02", v, zone)
+		}
+		app_id := 0
+		if v := q.Get("app_id"); v != "" && err == nil {
+			app_id, err = strconv.Atoi(v)
+		}
+		if err != nil || to.Before(from) {
+			errorWithJSON(w, r, errAnalyticsParams)
+			return
+		}
+
+		report, err := revenueReport(r, session.DB("simple").C(liveEnv.Orders), cfg, from, to.AddDate(0, 0, 1), app_id, period, by)
+		if err != nil {
+			reqLog(r).Error("revenue report", "err", err)
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		if q.Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=revenue_%s_%s.csv", from.Format("20060102"), to.Format("20060102")))
+			w.WriteHeader(http.StatusOK)
+			w.Write(revenueCSV(report))
+			return
+		}
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal report", "err", err)
+		}
+		ResponseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
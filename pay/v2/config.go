@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Настройки сервиса берутся из переменных окружения контейнера
+type Config struct {
+	MongoURL         string        //Строка подключения к mongodb
+	Listen           string        //Адрес, на котором слушаем http
+	LogLevel         string        //debug, info, warn, error
+	LogSyslog        string        //Адрес syslog (udp://172.17.0.1:514), пусто - писать в stdout
+	LogBodyRoutes    []string      //Маршруты, для которых пишется тело запроса (только на уровне debug)
+	CorsOrigins      []string      //Разрешенные Origin для браузерных запросов
+	CorsMaxAge       int           //Время кеширования preflight в секундах
+	RateLimits       []string      //Лимиты запросов по маршрутам, "PUT /users/:id=10/1m:20"
+	RateStore        string        //memory - в памяти процесса, mongo - общий для реплик
+	TraceExporter    string        //otlp, stdout или пусто (трейсинг выключен)
+	LangDefault      string        //Язык полей title/description в витрине
+	LangFallback     []string      //Языки витрины, если нет перевода на язык игрока
+	AdminToken       string        //Токен для /admin, пусто - админские маршруты выключены
+	RetryInterval    time.Duration //Как часто искать заказы для повторной выдачи
+	RetryBase        time.Duration //Пауза после первой неудачной выдачи, дальше удваивается
+	RetryMax         time.Duration //Максимальная пауза между попытками
+	RetryMaxAttempts int           //После стольких попыток заказ ждет ручного разбора (needs_manual)
+	GrantLease       time.Duration //Сколько заказ может быть в granting (потом ждет ручного разбора) или refunding
+	ReportUTCOffset  int           //Часовой пояс отчетов аналитики, часы от UTC
+	SandboxApps      []string      //app_id, все платежи которых идут в песочницу
+	SandboxTesters   []string      //id VK тестировщиков, их платежи идут в песочницу
+	VKSecrets        []string      //Секретные ключи приложений "app_id=secret" для проверки подписи
+	AllowUnsigned    bool          //Принимать уведомления песочницы без подписи, если нет ключа приложения
+	SimpleURL        string        //Адрес simple для проверки достижений после покупки, пусто - не вызывать
+	SimpleToken      string        //ADMIN_TOKEN сервиса simple
+	SnapshotKeep     int           //Сколько снимков игрока хранить для отката (как в simple)
+}
+
+func loadConfig() Config {
+	var cfg Config
+	cfg.MongoURL = getEnv("MONGO_URL", "mongodb://172.17.0.1:27017/simple")
+	cfg.Listen = getEnv("LISTEN", ":8000")
+	cfg.LogLevel = getEnv("LOG_LEVEL", "info")
+	cfg.LogSyslog = getEnv("LOG_SYSLOG", "")
+	cfg.LogBodyRoutes = getEnvList("LOG_BODY_ROUTES", "")
+	cfg.CorsOrigins = getEnvList("CORS_ORIGINS", "https://naogames.ru,https://www.naogames.ru,https://vk.com,https://*.vk.com")
+	cfg.CorsMaxAge = getEnvInt("CORS_MAX_AGE", 600)
+	cfg.RateLimits = getEnvList("RATE_LIMITS", "GET /orders/{user}/{app}=30/1m:10,GET /gifts/{user}/{app}=30/1m:10")
+	cfg.RateStore = getEnv("RATE_STORE", "memory")
+	cfg.TraceExporter = getEnv("TRACE_EXPORTER", "")
+	cfg.LangDefault = getEnv("LANG_DEFAULT", "ru")
+	cfg.LangFallback = getEnvList("LANG_FALLBACK", "en")
+	cfg.AdminToken = getEnv("ADMIN_TOKEN", "")
+	cfg.RetryInterval = getEnvDuration("RETRY_INTERVAL", 30*time.Second)
+	cfg.RetryBase = getEnvDuration("RETRY_BASE", time.Minute)
+	cfg.RetryMax = getEnvDuration("RETRY_MAX", time.Hour)
+	cfg.RetryMaxAttempts = getEnvInt("RETRY_MAX_ATTEMPTS", 10)
+	cfg.GrantLease = getEnvDuration("GRANT_LEASE", 2*time.Minute)
+	cfg.ReportUTCOffset = getEnvInt("REPORT_UTC_OFFSET", 3)
+	cfg.SandboxApps = getEnvList("SANDBOX_APPS", "")
+	cfg.SandboxTesters = getEnvList("SANDBOX_TESTERS", "")
+	cfg.VKSecrets = getEnvList("VK_SECRETS", "")
+	cfg.AllowUnsigned = getEnv("VK_ALLOW_UNSIGNED", "") == "1"
+	cfg.SimpleURL = getEnv("SIMPLE_URL", "")
+	cfg.SimpleToken = getEnv("SIMPLE_ADMIN_TOKEN", "")
+	cfg.SnapshotKeep = getEnvInt("SNAPSHOT_KEEP", 20)
+	return cfg
+}
+
+func getEnv(key string, def string) string {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	return val
+}
+
+func getEnvInt(key string, def int) int {
+	val, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	val, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvList(key string, def string) []string {
+	list := []string{}
+	for _, it := range strings.Split(getEnv(key, def), ",") {
+		it = strings.TrimSpace(it)
+		if it != "" {
+			list = append(list, it)
+		}
+	}
+	return list
+}
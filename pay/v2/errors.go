@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Ошибка REST API (orders и прочие не-VK маршруты): http код + машиночитаемый код.
+// Callback платежей VK отвечает по своему контракту, см. ErrorResponse.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"error_code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errParams       = &apiError{http.StatusBadRequest, "error_params", "error params"}
+	errDatabase     = &apiError{http.StatusInternalServerError, "database_error", "database error"}
+	errUserNotFound = &apiError{http.StatusNotFound, "user_not_found", "user not found"}
+	errRateLimited  = &apiError{http.StatusTooManyRequests, "rate_limited", "too many requests"}
+)
+
+func errorWithJSON(w http.ResponseWriter, r *http.Request, e *apiError) {
+	respBody, _ := json.Marshal(e)
+	ResponseWithJSON(w, r, respBody, e.Status)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const inboxCollection = "inbox"
+
+// Сообщение во входящих игрока. Пишет pay, читает и отмечает прочитанным simple.
+type InboxMessage struct {
+	ID           bson.ObjectId `json:"id" bson:"_id"`
+	User_id      string        `json:"user_id"` //Кому (id из users_arrows)
+	From_id      int           `json:"from_id"` //От кого (id VK)
+	Type         string        `json:"type"`    //gift
+	Text         string        `json:"text"`
+	App_id       int           `json:"app_id"`
+	App_order_id int           `json:"app_order_id"`
+	Parts        []OrderPart   `json:"parts"`
+	Date         int64         `json:"date"`
+	Read         bool          `json:"read"`
+}
+
+type GiftsResp struct {
+	Sent     []Order `json:"sent"`
+	Received []Order `json:"received"`
+}
+
+func ensureIndexInbox(session *mgo.Session) {
+	for _, env := range []payEnv{liveEnv, sandboxEnv} {
+		c := session.DB("simple").C(env.Inbox)
+		index := mgo.Index{
+			Key:        []string{"user_id", "-date"},
+			Background: true,
+		}
+		err := c.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// checkReceiver проверяет, что получатель покупки уже играет в игру.
+// Для подарка это единственная возможность отказать до списания денег.
+func checkReceiver(w http.ResponseWriter, r *http.Request, s *mgo.Session, env payEnv, receiver_id int) bool {
+	if env.Sandbox {
+		err := ensureSandboxUser(r, s, strconv.Itoa(receiver_id))
+		if err != nil {
+			ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+			return false
+		}
+	}
+
+	var count int
+	err := traceDB(r, "count", env.Users, func() (err error) {
+		count, err = s.DB("simple").C(env.Users).Find(bson.M{"id": strconv.Itoa(receiver_id)}).Count()
+		return err
+	})
+	if err != nil {
+		ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+		return false
+	}
+	if count == 0 {
+		ErrorResponse(w, r, 22, "Пользователь не существует", true)
+		return false
+	}
+	return true
+}
+
+// notifyGift кладет получателю подарка сообщение во входящие.
+// Подарок к этому моменту уже выдан, поэтому ошибка только пишется в лог.
+func notifyGift(r *http.Request, s *mgo.Session, env payEnv, order Order) {
+	var msg InboxMessage
+	msg.ID = bson.NewObjectId()
+	msg.User_id = strconv.Itoa(order.Receiver_id)
+	msg.From_id = order.User_id
+	msg.Type = "gift"
+	msg.Text = giftText(order)
+	msg.App_id = order.App_id
+	msg.App_order_id = order.App_order_id
+	msg.Parts = order.Parts
+	msg.Date = time.Now().Unix()
+
+	err := traceDB(r, "insert", env.Inbox, func() error {
+		return s.DB("simple").C(env.Inbox).Insert(msg)
+	})
+	if err != nil {
+		reqLog(r).Error("gift notification", "app_order_id", order.App_order_id, "err", err)
+	}
+}
+
+// giftText - текст уведомления. Имя дарителя клиент берет из VK по From_id,
+// в тексте оставляем место под него.
+func giftText(order Order) string {
+	title := order.Item_title
+	if title == "" {
+		names := []string{}
+		for _, part := range order.Parts {
+			names = append(names, fmt.Sprintf("%s x%d", part.Item, part.Count))
+		}
+		title = strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("{from} дарит вам: %s", title)
+}
+
+// giftsHandler - история подарков игрока: отправленные и полученные
+func giftsHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		vars := mux.Vars(r)
+		user, err := strconv.Atoi(vars["user"])
+		if err != nil {
+			errorWithJSON(w, r, errParams)
+			return
+		}
+		app, err := strconv.Atoi(vars["app"])
+		if err != nil {
+			errorWithJSON(w, r, errParams)
+			return
+		}
+
+		c := session.DB("simple").C(liveEnv.Orders)
+
+		var gifts GiftsResp
+		err = traceDB(r, "find", liveEnv.Orders, func() error {
+			err := c.Find(bson.M{"user_id": user, "app_id": app, "gift": true}).Sort("-date").All(&gifts.Sent)
+			if err != nil {
+				return err
+			}
+			return c.Find(bson.M{"receiver_id": user, "app_id": app, "gift": true}).Sort("-date").All(&gifts.Received)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+		if gifts.Sent == nil {
+			gifts.Sent = []Order{}
+		}
+		if gifts.Received == nil {
+			gifts.Received = []Order{}
+		}
+
+		respBody, err := json.MarshalIndent(gifts, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal gifts", "err", err)
+		}
+		ResponseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
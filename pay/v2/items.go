@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Что дает игроку обычный товар. Таблица общая с simple (там награды)
+// и задается в items.yaml, в базу ее пишет gamectl catalog apply.
+const effectsCollection = "item_effects"
+
+type itemEffect struct {
+	Item       string `json:"item" bson:"_id"`
+	All_ok     bool   `json:"all_ok"`     //Полная разблокировка
+	Live_count int    `json:"live_count"` //Сколько добавить жизней
+	Hint_fstep int    `json:"hint_fstep"` //Сколько добавить подсказок первого хода
+	Hint_back  int    `json:"hint_back"`  //Сколько добавить отмен хода
+	Reset      bool   `json:"reset"`      //Сброс прогресса и рейтинга
+}
+
+// loadItemEffects читает действия товаров names
+func loadItemEffects(r *http.Request, s *mgo.Session, names []string) (map[string]itemEffect, error) {
+	var list []itemEffect
+	err := traceDB(r, "find", effectsCollection, func() error {
+		return s.DB("simple").C(effectsCollection).Find(bson.M{"_id": bson.M{"$in": names}}).All(&list)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	effects := make(map[string]itemEffect)
+	for _, it := range list {
+		effects[it.Item] = it
+	}
+	for _, name := range names {
+		if _, ok := effects[name]; !ok {
+			return nil, unknownItemError(name)
+		}
+	}
+	return effects, nil
+}
+
+// Товара нет в таблице действий: выдать его нечем
+type unknownItemError string
+
+func (e unknownItemError) Error() string {
+	return "Неизвестный товар " + string(e)
+}
+
+// checkItemEffects проверяет, что товар (или все части набора) можно выдать,
+// чтобы VK не списал деньги за то, что игрок не получит. При ошибке сам
+// отвечает VK.
+func checkItemEffects(w http.ResponseWriter, r *http.Request, s *mgo.Session, item Item) bool {
+	names := []string{item.Item}
+	if len(item.Bundle) > 0 {
+		names = []string{}
+		for _, part := range item.Bundle {
+			names = append(names, part.Item)
+		}
+	}
+
+	_, err := loadItemEffects(r, s, names)
+	if _, ok := err.(unknownItemError); ok {
+		reqLog(r).Error("item without effect", "item", item.Item, "err", err)
+		ErrorResponse(w, r, 20, "Товар недоступен", true)
+		return false
+	}
+	if err != nil {
+		ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+		return false
+	}
+	return true
+}
+
+// orderEffects - действия всех частей заказа
+func orderEffects(r *http.Request, s *mgo.Session, order Order) (map[string]itemEffect, error) {
+	names := []string{}
+	for _, part := range order.Parts {
+		names = append(names, part.Item)
+	}
+	return loadItemEffects(r, s, names)
+}
+
+// applyItem применяет к игроку один базовый товар
+func applyItem(user *User, effect itemEffect) {
+	if effect.Reset { //Сброс прогресса и рейтинга
+		user.GamePoints = "0"
+		user.LvlOk = "0"
+		user.LiveCount = strconv.Itoa(live_count_init)
+		user.PriceTime = "0"
+		user.GameLvlTry = "0"
+	}
+	if effect.All_ok { //Полная разблокировка
+		user.AllOk = "1"
+	}
+	for currency, n := range map[string]int{"live_count": effect.Live_count, "hint_fstep": effect.Hint_fstep, "hint_back": effect.Hint_back} {
+		if n != 0 {
+			setUserCounter(user, currency, userCounter(*user, currency)+n)
+		}
+	}
+}
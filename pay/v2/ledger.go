@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"common/ledger"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Журнал операций с валютой игрока общий с simple (там история и сверка
+// балансов) и лежит в common/ledger. Индексы журнала создает и simple, но pay
+// может запуститься первым, а без уникального opening_key начальный баланс
+// может записаться дважды.
+func ensureIndexLedger(session *mgo.Session) {
+	for _, env := range []payEnv{liveEnv, sandboxEnv} {
+		err := ledger.EnsureIndex(session.DB("simple").C(env.Ledger))
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// userCounter - значение счетчика валюты в документе игрока
+func userCounter(user User, currency string) int {
+	var val string
+	switch currency {
+	case "live_count":
+		val = user.LiveCount
+	case "hint_fstep":
+		val = user.HintFstep
+	case "hint_back":
+		val = user.HintBack
+	}
+	n, _ := strconv.Atoi(val)
+	return n
+}
+
+// setUserCounter записывает значение счетчика валюты в документ игрока
+func setUserCounter(user *User, currency string, n int) {
+	val := strconv.Itoa(n)
+	switch currency {
+	case "live_count":
+		user.LiveCount = val
+	case "hint_fstep":
+		user.HintFstep = val
+	case "hint_back":
+		user.HintBack = val
+	}
+}
+
+// ledgerUserChanges пишет в журнал разницу счетчиков между двумя версиями игрока
+func ledgerUserChanges(r *http.Request, s *mgo.Session, collection string, before User, after User, other string, reason string, ref string, comment string) {
+	c := s.DB("simple").C(collection)
+	for _, currency := range ledger.Currencies {
+		err := ledger.Write(r, c, after.ID, currency, userCounter(before, currency), userCounter(after, currency), other, reason, ref, comment)
+		if err != nil {
+			reqLog(r).Error("ledger write", "user_id", after.ID, "currency", currency, "err", err)
+		}
+	}
+}
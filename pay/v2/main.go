@@ -3,23 +3,31 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
 
 	//"bytes"
 	"bytes"
 	"io/ioutil"
+	"net/url"
 	"strconv"
-	"strings"
+	"time"
+
+	"common/ledger"
+	"common/middleware"
 
 	"github.com/gorilla/mux"
 	"github.com/night-codes/mgo-ai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 const userCollection string = "users_arrows"
 
+const live_count_init = 5
+
 type User struct {
 	ID         string `json:"id"`           //Идентификатор
 	LvlOk      string `json:"lvl_ok"`       //Номер последнего пройденного уровня
@@ -41,12 +49,29 @@ type User struct {
 }
 
 type Item struct {
-	App_id    int    `json:"app_id"`
-	Item      string `json:"item"`
-	Title     string `json:"title"`
-	Photo_url string `json:"photo_url"`
-	Price     int    `json:"price"`
-	Item_id   string `json:"item_id"`
+	App_id        int               `json:"app_id"`
+	Item          string            `json:"item"`
+	Title         string            `json:"title"`        //Название по умолчанию
+	Titles        map[string]string `json:"titles"`       //Названия по языкам (ru, en, en_us)
+	Description   string            `json:"description"`  //Описание по умолчанию
+	Descriptions  map[string]string `json:"descriptions"` //Описания по языкам
+	Photo_url     string            `json:"photo_url"`
+	Price         int               `json:"price"`
+	Item_id       string            `json:"item_id"`
+	Sale_price    int               `json:"sale_price"`    //Цена по акции, 0 - акции нет
+	Sale_start    int64             `json:"sale_start"`    //Начало акции (unix time), 0 - без ограничения
+	Sale_end      int64             `json:"sale_end"`      //Конец акции (unix time), 0 - без ограничения
+	Sale_limit    int               `json:"sale_limit"`    //Сколько раз игрок может купить по акции, 0 - без ограничения
+	Limit_total   int               `json:"limit_total"`   //Сколько раз можно купить на аккаунт, 0 - без ограничения
+	Limit_daily   int               `json:"limit_daily"`   //Сколько раз можно купить за сутки, 0 - без ограничения
+	Unless_all_ok bool              `json:"unless_all_ok"` //Нельзя купить, если у игрока уже все разблокировано
+	Bundle        []BundlePart      `json:"bundle"`        //Состав набора, пусто - обычный товар
+}
+
+// Часть набора: базовый товар витрины и его количество
+type BundlePart struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
 }
 
 type ItemResp struct {
@@ -58,18 +83,38 @@ type ItemResp struct {
 }
 
 type Order struct {
-	App_order_id   int    `json:"app_order_id"`
-	App_id         int    `json:"app_id"`
-	User_id        int    `json:"user_id"`
-	Receiver_id    int    `json:"receiver_id"`
-	Order_id       int    `json:"order_id"`
-	Date           int    `json:"date"`
-	Status         string `json:"status"`
-	Item           string `json:"item"`
-	Item_id        string `json:"item_id"`
-	Item_title     string `json:"item_title"`
-	Item_photo_url string `json:"item_photo_url"`
-	Item_price     string `json:"item_price"`
+	App_order_id   int               `json:"app_order_id"`
+	App_id         int               `json:"app_id"`
+	User_id        int               `json:"user_id"`
+	Receiver_id    int               `json:"receiver_id"`
+	Order_id       int               `json:"order_id"`
+	Date           int               `json:"date"`
+	Status         string            `json:"status"`
+	Item           string            `json:"item"`
+	Item_id        string            `json:"item_id"`
+	Item_title     string            `json:"item_title"`
+	Item_photo_url string            `json:"item_photo_url"`
+	Item_price     string            `json:"item_price"`
+	Lang           string            `json:"lang"`       //Язык, на котором игрок видел товар
+	Sale           bool              `json:"sale"`       //Куплен по акции
+	Parts          []OrderPart       `json:"parts"`      //Что получил игрок (для набора - по частям)
+	Gift           bool              `json:"gift"`       //Подарок: плательщик и получатель разные
+	State          string            `json:"state"`      //pending, granting, granted, grant_failed, needs_manual, refunding, refunded
+	History        []OrderTransition `json:"history"`    //Все переходы состояния
+	Attempts       int               `json:"attempts"`   //Попытки выдачи покупки
+	Next_retry     int64             `json:"next_retry"` //Когда повторить выдачу (unix time)
+	Last_error     string            `json:"last_error"`
+	Lease_until    int64             `json:"lease_until"` //До какого времени заказ занят выдачей или возвратом
+	Refund_from    string            `json:"refund_from"` //Состояние, из которого начат возврат
+	Amount         int               `json:"amount"`      //Item_price числом, для аналитики
+	First          bool              `json:"first"`       //Первая покупка плательщика в приложении
+}
+
+// Часть заказа. Price - доля цены заказа, приходящаяся на эту часть
+type OrderPart struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+	Price int    `json:"price"`
 }
 
 type OrderResp struct {
@@ -92,10 +137,18 @@ type ResponseOK struct {
 }
 
 func main() {
-	conn_string := fmt.Sprintf("mongodb://172.17.0.1:27017/simple")
-	log.Println("connection string: " + conn_string)
+	cfg := loadConfig()
+	initLogger(cfg, "pay_v2")
+	shutdownTracing := initTracing(cfg, "pay_v2")
+	initSnapshots(cfg)
+
+	if len(cfg.VKSecrets) == 0 {
+		logger.Warn("VK_SECRETS is empty, payment notifications will be rejected", "allow_unsigned_sandbox", cfg.AllowUnsigned)
+	}
+
+	logger.Info("connecting to mongodb", "addr", cfg.MongoURL)
 
-	session, err := mgo.Dial(conn_string)
+	session, err := mgo.Dial(cfg.MongoURL)
 	if err != nil {
 		panic(err)
 	}
@@ -103,19 +156,33 @@ func main() {
 
 	session.SetMode(mgo.Monotonic, true)
 	ensureIndex(session)
+	go backfillAnalytics(session)
+
+	limit := newLimiter(cfg, session)
+
+	go retryWorker(cfg, session)
 
 	r := mux.NewRouter()
 
 	// Routes consist of a path and a handler function.
-	r.HandleFunc("/*", preflightHandler).Methods("OPTIONS")
-	r.HandleFunc("/", processHandler(session)).Methods("POST")
-	r.HandleFunc("/orders/{user}/{app}", ordersHandler(session)).Methods("GET")
+	// Уведомления VK не ограничиваются: они идут за всех игроков с нескольких
+	// серверов VK, а ответ 429 не входит в протокол платежей
+	r.HandleFunc("/", logBody(cfg, "/", processHandler(cfg, session))).Methods("POST")
+	r.HandleFunc("/orders/{user}/{app}", limit.Wrap("GET /orders/{user}/{app}", varsUser, ordersHandler(session))).Methods("GET")
 	r.HandleFunc("/test/orders/{user}/{app}", orders_testHandler(session)).Methods("GET")
+	r.HandleFunc("/test/users/{user}", sandboxUserHandler(session)).Methods("GET")
+	r.HandleFunc("/test/users/{user}", adminOnly(cfg, sandboxResetHandler(session))).Methods("DELETE")
+	r.HandleFunc("/gifts/{user}/{app}", limit.Wrap("GET /gifts/{user}/{app}", varsUser, giftsHandler(session))).Methods("GET")
+	r.HandleFunc("/admin/analytics/revenue", adminOnly(cfg, revenueHandler(cfg, session))).Methods("GET")
+	r.HandleFunc("/admin/orders/{app_order_id}/retry", adminOnly(cfg, adminRetryOrder(session))).Methods("POST")
 	r.HandleFunc("/healthcheck", healthcheckHandler).Methods("GET")
 
-	log.Println("server started on port ", 8000)
+	logger.Info("server started", "addr", cfg.Listen)
 	// Bind to a port and pass our router in
-	log.Fatal(http.ListenAndServe(":8000", r))
+	err = http.ListenAndServe(cfg.Listen, middleware.WithTracing(middleware.WithRequestID(middleware.CORS(cfg.CorsOrigins, cfg.CorsMaxAge, r))))
+	logger.Error("server stopped", "err", err)
+	shutdownTracing()
+	os.Exit(1)
 }
 
 func ensureIndex(s *mgo.Session) {
@@ -124,20 +191,41 @@ func ensureIndex(s *mgo.Session) {
 
 	ensureIndexPay(s)
 	ensureIndexShowcase(s)
+	ensureIndexInbox(s)
+	ensureIndexAnalytics(s)
+	ensureIndexSandbox(s)
+	ensureIndexSnapshots(s)
+	ensureIndexLedger(s)
 }
 
 func ensureIndexPay(session *mgo.Session) {
-	c := session.DB("simple").C("pay")
-	index := mgo.Index{
-		Key:        []string{"app_order_id"},
-		Unique:     true,
-		DropDups:   true,
-		Background: true,
-		Sparse:     true,
-	}
-	err := c.EnsureIndex(index)
-	if err != nil {
-		panic(err)
+	for _, env := range []payEnv{liveEnv, sandboxEnv} {
+		c := session.DB("simple").C(env.Orders)
+		index := mgo.Index{
+			Key:        []string{"app_order_id"},
+			Unique:     true,
+			DropDups:   true,
+			Background: true,
+			Sparse:     true,
+		}
+		err := c.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, key := range [][]string{{"order_id"}, {"state", "next_retry"}} {
+			index = mgo.Index{
+				Key:        key,
+				Unique:     key[0] == "order_id",
+				Background: true,
+				Sparse:     true,
+			}
+			// В старых данных order_id мог повторяться, сервис из-за этого не останавливаем
+			err = c.EnsureIndex(index)
+			if err != nil {
+				logger.Error("ensure index", "collection", env.Orders, "key", key, "err", err)
+			}
+		}
 	}
 }
 
@@ -159,88 +247,127 @@ func ensureIndexShowcase(session *mgo.Session) {
 func ResponseWithString(w http.ResponseWriter, r *http.Request, message string, code int) {
 	buf := bytes.NewBufferString("")
 	fmt.Fprintf(buf, "{\"message\": %q}", message)
-	ResponseWithJSON(w, r, buf.Bytes(), http.StatusOK)
+	ResponseWithJSON(w, r, buf.Bytes(), code)
 }
 
 func ResponseWithJSON(w http.ResponseWriter, r *http.Request, json []byte, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 	w.WriteHeader(code)
 	w.Write(json)
-
-	log.Println("response:")
-	log.Println(string(json))
-}
-
-func preflightHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Accept-Encoding, Destination, Content-Type, Content-Length")
-	w.WriteHeader(http.StatusOK)
 }
 
 func healthcheckHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("new healthcheck request")
+	reqLog(r).Debug("healthcheck")
 	ResponseWithString(w, r, "pass", http.StatusOK)
 }
 
-func processHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func varsUser(r *http.Request) string {
+	return mux.Vars(r)["user"]
+}
+
+func processHandler(cfg Config, s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		log.Println("new request:")
-		log.Println(string(bodyBytes))
 
 		session := s.Copy()
 		defer session.Close()
 
-		c_pay := session.DB("simple").C("pay")
-		c_pay_test := session.DB("simple").C("pay_test")
 		c_showcase := session.DB("simple").C("showcase")
 		ai.Connect(session.DB("simple").C("counters"))
 
-		ss := strings.Split(string(bodyBytes), "&")
+		vals, err := url.ParseQuery(string(bodyBytes))
+		if err != nil {
+			reqLog(r).Warn("bad notification body", "err", err)
+		}
 		parms := make(map[string]string)
-		for _, pair := range ss {
-			z := strings.Split(pair, "=")
-			parms[z[0]] = z[1]
+		for key := range vals {
+			parms[key] = vals.Get(key)
 		}
 
-		log.Println("api request: " + parms["notification_type"])
+		env, ntype := notificationEnv(cfg, parms)
+		c_pay := session.DB("simple").C(env.Orders)
+
+		reqLog(r).Info("notification",
+			"notification_type", parms["notification_type"],
+			"app_id", parms["app_id"],
+			"item", parms["item"],
+			"order_id", parms["order_id"],
+			"sandbox", env.Sandbox)
+		traceAttrs(r,
+			attribute.Bool("pay.sandbox", env.Sandbox),
+			attribute.String("vk.notification_type", parms["notification_type"]),
+			attribute.String("vk.user_id", parms["user_id"]),
+			attribute.String("vk.receiver_id", parms["receiver_id"]),
+			attribute.String("vk.item", parms["item"]),
+			attribute.String("vk.order_id", parms["order_id"]))
+
+		if !checkSignature(cfg, r, env, parms) {
+			ErrorResponse(w, r, 10, "Несовпадение вычисленной и переданной подписи", true)
+			return
+		}
 
-		switch parms["notification_type"] {
-		case "get_item", "get_item_test":
+		switch ntype {
+		case "get_item":
 			{
-				log.Println("find item: app_id=" + parms["app_id"] + " item=\"" + parms["item"] + "\"")
 				app_id, _ := strconv.Atoi(parms["app_id"])
-				var item Item
-				err := c_showcase.Find(bson.M{"app_id": app_id, "item": parms["item"]}).One(&item)
+				item, ok := findItem(w, r, c_showcase, app_id, parms["item"])
+				if !ok || !checkItemEffects(w, r, session, item) {
+					return
+				}
+
+				now := time.Now()
+				receiver_id, err := strconv.Atoi(parms["receiver_id"])
 				if err != nil {
-					ErrorResponse(w, r, 20, "Товар не существует", true)
+					receiver_id, _ = strconv.Atoi(parms["user_id"])
+				}
+				if !checkReceiver(w, r, session, env, receiver_id) {
+					return
+				}
+				if !checkItemLimits(w, r, session, env, item, receiver_id, now) {
 					return
 				}
 
 				var item_resp ItemResp
-				item_resp.Title = item.Title
+				item_resp.Title = item.LocalizedTitle(cfg, parms["lang"])
 				item_resp.Photo_url = item.Photo_url
-				item_resp.Price = item.Price
+				user_id, _ := strconv.Atoi(parms["user_id"])
+				sales, err := countSales(c_pay, item, user_id)
+				if err != nil {
+					ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+					return
+				}
+
+				item_resp.Price = item.EffectivePrice(now, sales)
 				item_resp.Item_id = item.Item_id
-				item_resp.Expiration = 600
+				item_resp.Expiration = item.Expiration(now)
 
 				OKResponse(w, r, item_resp)
 			}
 		case "order_status_change":
 			{
-
+				if parms["status"] == "refunded" {
+					refundOrder(cfg, w, r, session, env, parms)
+					return
+				}
 				if parms["status"] != "chargeable" {
 					ErrorResponse(w, r, 101, "Передано непонятно что вместо chargeable", true)
 					return
 				}
 
-				var err error
+				order_id, err := strconv.Atoi(parms["order_id"])
+				if err != nil {
+					ErrorResponse(w, r, 105, "Ошибка конвертации (order_id)", true)
+					return
+				}
+				// VK повторяет уведомление, пока не получит успешный ответ. Повтор по
+				// сохраненному заказу не проверяется заново: акция могла закончиться,
+				// а лимит товара - исчерпаться этим же заказом
+				if duplicateOrder(w, r, c_pay, order_id) {
+					return
+				}
 
 				var order Order
-				order.App_order_id = (int)(ai.Next("pay"))
+				order.App_order_id = (int)(ai.Next(env.Counter))
 				order.App_id, err = strconv.Atoi(parms["app_id"])
 				if err != nil {
 					ErrorResponse(w, r, 105, "Ошибка конвертации (app_id)", true)
@@ -256,11 +383,7 @@ func processHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 					ErrorResponse(w, r, 105, "Ошибка конвертации (receiver_id)", true)
 					return
 				}
-				order.Order_id, err = strconv.Atoi(parms["order_id"])
-				if err != nil {
-					ErrorResponse(w, r, 105, "Ошибка конвертации (order_id)", true)
-					return
-				}
+				order.Order_id = order_id
 				order.Date, err = strconv.Atoi(parms["date"])
 				if err != nil {
 					ErrorResponse(w, r, 105, "Ошибка конвертации (date)", true)
@@ -272,63 +395,50 @@ func processHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 				order.Item_title = parms["item_title"]
 				order.Item_photo_url = parms["item_photo_url"]
 				order.Item_price = parms["item_price"]
+				order.Lang = parms["lang"]
+				if order.Item_title == "" {
+					order.Item_title = shownTitle(cfg, c_showcase, order)
+				}
 
-				err = c_pay.Insert(order)
-				if err != nil {
-					if mgo.IsDup(err) {
-						ErrorResponse(w, r, 102, "Ордер покупки существует", true)
-					} else {
-						ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
-					}
+				item, ok := findItem(w, r, c_showcase, order.App_id, order.Item)
+				if !ok || !checkItemEffects(w, r, session, item) {
 					return
 				}
-
-				if update_user(w, r, session, parms, order.Item) != true {
-					c_pay.Remove(bson.M{"app_order_id": order.App_order_id})
+				if !checkOrderPrice(w, r, c_pay, item, &order) {
 					return
 				}
-
-				var order_resp OrderResp
-				order_resp.Order_id = order.Order_id
-				order_resp.App_order_id = order.App_order_id
-
-				OKResponse(w, r, order_resp)
-			}
-		case "order_status_change_test":
-			{
-				if parms["status"] != "chargeable" {
-					ErrorResponse(w, r, 101, "Передано непонятно что вместо chargeable", true)
+				order.Parts = orderParts(c_showcase, item, order.Item_price)
+				if !checkReceiver(w, r, session, env, order.Receiver_id) {
+					return
+				}
+				if !checkItemLimits(w, r, session, env, item, order.Receiver_id, time.Now()) {
+					return
+				}
+				order.Gift = order.User_id != order.Receiver_id
+				newOrderState(&order, orderPending, time.Now())
+				if markFirstPurchase(r, c_pay, &order) != nil {
+					ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
 					return
 				}
 
-				var order Order
-				order.App_order_id = (int)(ai.Next("test"))
-				order.App_id, _ = strconv.Atoi(parms["app_id"])
-				order.User_id, _ = strconv.Atoi(parms["user_id"])
-				order.Receiver_id, _ = strconv.Atoi(parms["receiver_id"])
-				order.Order_id, _ = strconv.Atoi(parms["order_id"])
-				order.Date, _ = strconv.Atoi(parms["date"])
-				order.Status = parms["status"]
-				order.Item = parms["item"]
-				order.Item_id = parms["item_id"]
-				order.Item_title = parms["item_title"]
-				order.Item_photo_url = parms["item_photo_url"]
-				order.Item_price = parms["item_price"]
-
-				err := c_pay_test.Insert(order)
+				err = traceDB(r, "insert", env.Orders, func() error {
+					return c_pay.Insert(order)
+				})
 				if err != nil {
 					if mgo.IsDup(err) {
-						ErrorResponse(w, r, 102, "Ордер покупки существует", true)
+						// Повтор пришел, пока первое уведомление еще обрабатывалось
+						if !duplicateOrder(w, r, c_pay, order.Order_id) {
+							ErrorResponse(w, r, 102, "Ордер покупки существует", true)
+						}
 					} else {
 						ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
 					}
 					return
 				}
 
-				if update_user(w, r, session, parms, order.Item) != true {
-					c_pay_test.Remove(bson.M{"app_order_id": order.App_order_id})
-					return
-				}
+				// Заказ уже сохранен, поэтому VK получает успешный ответ, даже если
+				// выдать покупку сразу не получилось - ее довыдаст retryWorker
+				grantOrder(cfg, r, session, env, order)
 
 				var order_resp OrderResp
 				order_resp.Order_id = order.Order_id
@@ -344,79 +454,73 @@ func processHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func update_user(w http.ResponseWriter, r *http.Request, s *mgo.Session, parms map[string]string, item string) bool {
-	users := s.DB("simple").C(userCollection)
+// shownTitle - название товара на языке игрока, если VK не прислал item_title.
+// Сохраняется в заказе, чтобы список покупок не менялся при правке витрины.
+func shownTitle(cfg Config, c *mgo.Collection, order Order) string {
+	var item Item
+	err := c.Find(bson.M{"app_id": order.App_id, "item": order.Item}).One(&item)
+	if err != nil {
+		return order.Item
+	}
+	return item.LocalizedTitle(cfg, order.Lang)
+}
+
+// update_user выдает покупку получателю заказа. Ошибка сохраняется в заказе
+// (состояние grant_failed), и выдачу повторяет retryWorker.
+func update_user(r *http.Request, s *mgo.Session, env payEnv, order Order) error {
+	receiver := strconv.Itoa(order.Receiver_id)
+	ctx, span := middleware.Tracer().Start(r.Context(), "update_user", trace.WithAttributes(
+		attribute.String("vk.receiver_id", receiver),
+		attribute.String("vk.item", order.Item),
+		attribute.Bool("pay.sandbox", env.Sandbox)))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	users := s.DB("simple").C(env.Users)
 
 	//------------------------------
 	var user User
-	err := users.Find(bson.M{"id": parms["receiver_id"]}).One(&user)
+	err := traceDB(r, "find", env.Users, func() error {
+		return users.Find(bson.M{"id": receiver}).One(&user)
+	})
 	if err != nil {
-		ErrorResponse(w, r, 103, "Пользователь не существует (nil)", true)
-		return false
+		span.RecordError(err)
+		return fmt.Errorf("Пользователь не существует: %v", err)
 	}
 
 	if user.ID == "" {
-		ErrorResponse(w, r, 103, "Пользователь не существует", true)
-		return false
+		return fmt.Errorf("Пользователь не существует")
 	}
 
-	var live_count_init = 5
-
-	if item == "buy_all" { //Полная разблокировка
-		user.AllOk = "1"
-	}
-	if item == "buy_life_small" { //Восстановление жизней
-		val, _ := strconv.Atoi(user.LiveCount)
-		user.LiveCount = fmt.Sprintf("%d", val+live_count_init)
-	}
-	if item == "buy_life_mid" { //В 2 раза больше жизней
-		val, _ := strconv.Atoi(user.LiveCount)
-		user.LiveCount = fmt.Sprintf("%d", val+(2*live_count_init))
-	}
-	if item == "buy_life_large" { //В 5 раз больше жизней
-		val, _ := strconv.Atoi(user.LiveCount)
-		user.LiveCount = fmt.Sprintf("%d", val+(5*live_count_init))
-	}
-	if item == "buy_fstep_small" { //+10 подсказок первого хода
-		val, _ := strconv.Atoi(user.HintFstep)
-		user.HintFstep = fmt.Sprintf("%d", val+10)
-	}
-	if item == "buy_fstep_mid" { //+25 подсказок первого хода
-		val, _ := strconv.Atoi(user.HintFstep)
-		user.HintFstep = fmt.Sprintf("%d", val+25)
-	}
-	if item == "buy_fstep_large" { //+50 подсказок первого хода
-		val, _ := strconv.Atoi(user.HintFstep)
-		user.HintFstep = fmt.Sprintf("%d", val+50)
-	}
-	if item == "buy_back_small" { //+10 отмен хода
-		val, _ := strconv.Atoi(user.HintBack)
-		user.HintBack = fmt.Sprintf("%d", val+10)
-	}
-	if item == "buy_back_mid" { //+25 отмен хода
-		val, _ := strconv.Atoi(user.HintBack)
-		user.HintBack = fmt.Sprintf("%d", val+25)
-	}
-	if item == "buy_back_large" { //+50 отмен хода
-		val, _ := strconv.Atoi(user.HintBack)
-		user.HintBack = fmt.Sprintf("%d", val+50)
+	effects, err := orderEffects(r, s, order)
+	if err != nil {
+		span.RecordError(err)
+		return err
 	}
-	if item == "buy_reset" { //Сброс прогресса и рейтинга
-		user.GamePoints = "0"
-		user.LvlOk = "0"
-		user.LiveCount = fmt.Sprintf("%d", live_count_init)
-		user.PriceTime = "0"
-		user.GameLvlTry = "0"
+
+	saveSnapshot(r, s, env, user, snapshotPurchase)
+	before := user
+
+	// Все части набора применяются к одному документу и сохраняются одним
+	// Update, так что игрок получает либо весь набор, либо ничего
+	for _, part := range order.Parts {
+		for i := 0; i < part.Count; i++ {
+			applyItem(&user, effects[part.Item])
+		}
 	}
 
-	err = users.Update(bson.M{"id": user.ID}, &user)
+	err = traceDB(r, "update", env.Users, func() error {
+		return users.Update(bson.M{"id": user.ID}, &user)
+	})
 	if err != nil {
-		ErrorResponse(w, r, 104, "Ошибка обновления пользователя", true)
-		return false
+		span.RecordError(err)
+		return fmt.Errorf("Ошибка обновления пользователя: %v", err)
 	}
+
+	ledgerUserChanges(r, s, env.Ledger, before, user, ledger.AccountShop, ledger.ReasonPurchase, orderRef(order), "")
 	//------------------------------
 
-	return true
+	return nil
 }
 
 func ordersHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
@@ -424,7 +528,7 @@ func ordersHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 		session := s.Copy()
 		defer session.Close()
 
-		c := session.DB("simple").C("pay")
+		c := session.DB("simple").C(liveEnv.Orders)
 
 		ordersResponse(w, r, c)
 	}
@@ -435,7 +539,7 @@ func orders_testHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Requ
 		session := s.Copy()
 		defer session.Close()
 
-		c := session.DB("simple").C("pay_test")
+		c := session.DB("simple").C(sandboxEnv.Orders)
 
 		ordersResponse(w, r, c)
 	}
@@ -443,55 +547,62 @@ func orders_testHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Requ
 
 func ordersResponse(w http.ResponseWriter, r *http.Request, c *mgo.Collection) {
 	vars := mux.Vars(r)
-	log.Println("new orders request: user=" + vars["user"] + " app=" + vars["app"])
+	reqLog(r).Info("orders request", "user", vars["user"], "app", vars["app"])
 
 	receiver, err := strconv.Atoi(vars["user"])
 	if err != nil {
-		ResponseWithString(w, r, "error params", http.StatusOK)
+		errorWithJSON(w, r, errParams)
 		return
 	}
 
 	app, err := strconv.Atoi(vars["app"])
 	if err != nil {
-		ResponseWithString(w, r, "error params", http.StatusOK)
+		errorWithJSON(w, r, errParams)
 		return
 	}
 
 	orders := []Order{}
-	err = c.Find(bson.M{"receiver_id": receiver, "app_id": app}).All(&orders)
+	err = traceDB(r, "find", c.Name, func() error {
+		return c.Find(bson.M{"receiver_id": receiver, "app_id": app}).All(&orders)
+	})
 	if err != nil {
-		ResponseWithString(w, r, "database error", http.StatusOK)
+		errorWithJSON(w, r, errDatabase)
 		return
 	}
 
 	respBody, err := json.MarshalIndent(orders, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		reqLog(r).Error("marshal orders", "err", err)
 	}
 
 	ResponseWithJSON(w, r, respBody, http.StatusOK)
 }
 
+// ErrorResponse - ответ callback платежей VK. VK ожидает http 200 и объект error
+// в теле, поэтому статус здесь не зависит от ошибки (в отличие от errorWithJSON).
 func ErrorResponse(w http.ResponseWriter, r *http.Request, error_code int, error_msg string, critical bool) {
 	var responseErr ResponseErr
 	responseErr.Error.Error_code = error_code
 	responseErr.Error.Error_msg = error_msg
 	responseErr.Error.Critical = critical
 
+	reqLog(r).Warn("error response", "error_code", error_code, "error_msg", error_msg)
+
 	respBody, err := json.Marshal(responseErr)
 	if err != nil {
-		log.Println("Error Marshal object")
+		reqLog(r).Error("marshal response", "err", err)
 	}
 	ResponseWithJSON(w, r, respBody, http.StatusOK)
 }
 
+// OKResponse - успешный ответ callback платежей VK
 func OKResponse(w http.ResponseWriter, r *http.Request, i interface{}) {
 	var rsp ResponseOK
 	rsp.Response = i
 
 	respBody, err := json.Marshal(rsp)
 	if err != nil {
-		log.Println("Error Marshal object")
+		reqLog(r).Error("marshal response", "err", err)
 	}
 	ResponseWithJSON(w, r, respBody, http.StatusOK)
 }
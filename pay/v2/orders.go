@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"common/ledger"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Состояния заказа
+//
+//	pending -> granting -> granted
+//	pending -> granting -> grant_failed -> granting -> granted
+//	grant_failed -> needs_manual (после RetryMaxAttempts попыток) -> grant_failed (admin retry)
+//	granting -> needs_manual (выдача не завершилась за GrantLease)
+//	pending, granted, grant_failed, needs_manual -> refunding -> refunded
+const (
+	orderPending     = "pending"
+	orderGranting    = "granting"
+	orderGranted     = "granted"
+	orderGrantFailed = "grant_failed"
+	orderManual      = "needs_manual"
+	orderRefunding   = "refunding"
+	orderRefunded    = "refunded"
+)
+
+// Переход заказа в новое состояние
+type OrderTransition struct {
+	State string `json:"state"`
+	Date  int64  `json:"date"`
+	Error string `json:"error"`
+}
+
+var (
+	errOrderNotFound = &apiError{http.StatusNotFound, "order_not_found", "order not found"}
+	errOrderState    = &apiError{http.StatusConflict, "order_state", "order is not waiting for retry"}
+)
+
+func orderRef(order Order) string {
+	return "vk_order:" + strconv.Itoa(order.Order_id)
+}
+
+func newOrderState(order *Order, state string, now time.Time) {
+	order.State = state
+	order.History = append(order.History, OrderTransition{State: state, Date: now.Unix()})
+}
+
+// setOrderState переводит заказ из состояния from в to, если заказ все еще
+// в состоянии from. Иначе возвращает mgo.ErrNotFound.
+func setOrderState(r *http.Request, c *mgo.Collection, app_order_id int, from string, to string, errMsg string, set bson.M) error {
+	now := time.Now().Unix()
+	if set == nil {
+		set = bson.M{}
+	}
+	set["state"] = to
+	set["last_error"] = errMsg
+
+	return traceDB(r, "update", c.Name, func() error {
+		return c.Update(bson.M{"app_order_id": app_order_id, "state": from}, bson.M{
+			"$set":  set,
+			"$push": bson.M{"history": OrderTransition{State: to, Date: now, Error: errMsg}},
+		})
+	})
+}
+
+// retryDelay - пауза перед следующей попыткой выдачи: экспонента от RetryBase,
+// но не больше RetryMax
+func retryDelay(cfg Config, attempts int) time.Duration {
+	delay := cfg.RetryBase
+	for i := 1; i < attempts && delay < cfg.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.RetryMax {
+		delay = cfg.RetryMax
+	}
+	return delay
+}
+
+// grantFailedState - состояние заказа после неудачной попытки выдачи номер attempts
+func grantFailedState(cfg Config, attempts int) string {
+	if attempts >= cfg.RetryMaxAttempts {
+		return orderManual
+	}
+	return orderGrantFailed
+}
+
+// grantOrder пробует выдать покупку по заказу в состоянии from
+// и записывает результат в заказ.
+//
+// Сначала заказ занимается переходом в granting, и только после этого
+// игроку выдаются товары. Занять заказ может только один из обработчика VK,
+// retryWorker на любой из реплик и admin retry, поэтому покупка не выдается
+// дважды. Если выдача прервалась и заказ остался в granting, повторять ее
+// нельзя - неизвестно, получил ли игрок товары. Такие заказы по истечении
+// GrantLease уходят на ручной разбор (expireGrantLeases).
+func grantOrder(cfg Config, r *http.Request, s *mgo.Session, env payEnv, order Order) bool {
+	c := s.DB("simple").C(env.Orders)
+	attempts := order.Attempts + 1
+
+	lease := time.Now().Add(cfg.GrantLease).Unix()
+	err := setOrderState(r, c, order.App_order_id, order.State, orderGranting, "", bson.M{"attempts": attempts, "lease_until": lease})
+	if err == mgo.ErrNotFound {
+		reqLog(r).Info("order already taken", "app_order_id", order.App_order_id, "state", order.State)
+		return false
+	}
+	if err != nil {
+		reqLog(r).Error("order state", "app_order_id", order.App_order_id, "state", orderGranting, "err", err)
+		return false
+	}
+
+	err = update_user(r, s, env, order)
+	if err == nil {
+		err = setOrderState(r, c, order.App_order_id, orderGranting, orderGranted, "", nil)
+		if err != nil {
+			reqLog(r).Error("order state", "app_order_id", order.App_order_id, "state", orderGranted, "err", err)
+		}
+		if order.Gift {
+			notifyGift(r, s, env, order)
+		}
+		// Игроков песочницы в simple нет
+		if !env.Sandbox {
+			achievementsHook(cfg, r, order.Receiver_id)
+			if order.Gift {
+				achievementsHook(cfg, r, order.User_id)
+			}
+		}
+		return true
+	}
+
+	reqLog(r).Error("grant failed", "app_order_id", order.App_order_id, "attempts", attempts, "err", err)
+
+	to := grantFailedState(cfg, attempts)
+	next := time.Now().Add(retryDelay(cfg, attempts)).Unix()
+	err2 := setOrderState(r, c, order.App_order_id, orderGranting, to, err.Error(), bson.M{"next_retry": next})
+	if err2 != nil {
+		reqLog(r).Error("order state", "app_order_id", order.App_order_id, "state", to, "err", err2)
+	}
+	return false
+}
+
+// duplicateOrder - VK повторил уведомление о заказе, который уже сохранен.
+// Отвечаем тем же, что и в первый раз, чтобы VK не отменил оплату.
+// Возвращает false, если заказа с таким order_id еще нет.
+func duplicateOrder(w http.ResponseWriter, r *http.Request, c *mgo.Collection, order_id int) bool {
+	var existing Order
+	err := traceDB(r, "find", c.Name, func() error {
+		return c.Find(bson.M{"order_id": order_id}).One(&existing)
+	})
+	if err == mgo.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+		return true
+	}
+
+	reqLog(r).Info("duplicate order notification", "order_id", order_id, "app_order_id", existing.App_order_id, "state", existing.State)
+
+	var order_resp OrderResp
+	order_resp.Order_id = existing.Order_id
+	order_resp.App_order_id = existing.App_order_id
+	OKResponse(w, r, order_resp)
+	return true
+}
+
+// Как обработать уведомление о возврате заказа в его текущем состоянии
+const (
+	refundDone  = iota //уже возвращен, ответить как в первый раз
+	refundBusy         //выдача или другой возврат еще идут, VK повторит позже
+	refundClaim        //занять заказ для возврата
+)
+
+// refundStep решает, что делать с возвратом заказа. Для refundClaim
+// возвращает состояние, из которого начат возврат (у прерванного возврата -
+// сохраненное в Refund_from), и нужно ли забирать выданное: только если
+// покупка была выдана (у старых заказов без состояний - всегда).
+func refundStep(order Order, now time.Time) (step int, from string, revoke bool) {
+	switch {
+	case order.State == orderRefunded:
+		return refundDone, "", false
+	case order.State == orderGranting:
+		return refundBusy, "", false
+	case order.State == orderRefunding && order.Lease_until > now.Unix():
+		return refundBusy, "", false
+	}
+
+	from = order.State
+	if order.State == orderRefunding {
+		from = order.Refund_from
+	}
+	return refundClaim, from, from == orderGranted || from == ""
+}
+
+// refundOrder обрабатывает возврат денег в VK: забирает выданное по заказу
+// (по записям журнала) и переводит заказ в refunded.
+//
+// Заказ сначала занимается переходом в refunding, так что параллельные
+// уведомления о возврате не забирают покупку дважды. Если возврат прервался,
+// VK повторит уведомление, и после GrantLease заказ можно занять снова.
+// Повторно забирать не нужно, если в журнале уже есть записи возврата.
+func refundOrder(cfg Config, w http.ResponseWriter, r *http.Request, s *mgo.Session, env payEnv, parms map[string]string) {
+	c := s.DB("simple").C(env.Orders)
+
+	order_id, err := strconv.Atoi(parms["order_id"])
+	if err != nil {
+		ErrorResponse(w, r, 105, "Ошибка конвертации (order_id)", true)
+		return
+	}
+
+	var order Order
+	err = traceDB(r, "find", c.Name, func() error {
+		return c.Find(bson.M{"order_id": order_id}).One(&order)
+	})
+	if err != nil {
+		ErrorResponse(w, r, 107, "Ордер покупки не найден", true)
+		return
+	}
+
+	var order_resp OrderResp
+	order_resp.Order_id = order.Order_id
+	order_resp.App_order_id = order.App_order_id
+
+	now := time.Now()
+	step, from, revoke := refundStep(order, now)
+	if step == refundDone {
+		OKResponse(w, r, order_resp)
+		return
+	}
+	if step == refundBusy {
+		ErrorResponse(w, r, 2, "Заказ обрабатывается, повторите позже", false)
+		return
+	}
+
+	err = claimRefund(r, c, order, from, now.Add(cfg.GrantLease).Unix())
+	if err == mgo.ErrNotFound {
+		ErrorResponse(w, r, 2, "Заказ обрабатывается, повторите позже", false)
+		return
+	}
+	if err != nil {
+		ErrorResponse(w, r, 2, "Временная ошибка базы данных", false)
+		return
+	}
+
+	if revoke {
+		err = revokeOrder(r, s, env, order)
+		if err != nil {
+			reqLog(r).Error("revoke order", "app_order_id", order.App_order_id, "err", err)
+			ErrorResponse(w, r, 2, "Временная ошибка базы данных", false)
+			return
+		}
+	}
+
+	err = setOrderState(r, c, order.App_order_id, orderRefunding, orderRefunded, "", bson.M{"status": parms["status"]})
+	if err != nil {
+		reqLog(r).Error("order state", "app_order_id", order.App_order_id, "state", orderRefunded, "err", err)
+		ErrorResponse(w, r, 2, "Временная ошибка базы данных", false)
+		return
+	}
+
+	OKResponse(w, r, order_resp)
+}
+
+// claimRefund занимает заказ для возврата. Условие на состояние (и срок
+// для прерванного возврата) пропускает только одно из параллельных уведомлений.
+func claimRefund(r *http.Request, c *mgo.Collection, order Order, from string, lease int64) error {
+	sel := bson.M{"app_order_id": order.App_order_id, "state": order.State}
+	if order.State == orderRefunding {
+		sel["lease_until"] = order.Lease_until
+	}
+	return traceDB(r, "update", c.Name, func() error {
+		return c.Update(sel, bson.M{
+			"$set":  bson.M{"state": orderRefunding, "lease_until": lease, "refund_from": from, "last_error": ""},
+			"$push": bson.M{"history": OrderTransition{State: orderRefunding, Date: time.Now().Unix()}},
+		})
+	})
+}
+
+// revokeOrder забирает у игрока валюту, начисленную по заказу, и полную
+// разблокировку. Сброс прогресса (buy_reset) вернуть нельзя.
+func revokeOrder(r *http.Request, s *mgo.Session, env payEnv, order Order) error {
+	users := s.DB("simple").C(env.Users)
+	receiver := strconv.Itoa(order.Receiver_id)
+
+	var user User
+	err := traceDB(r, "find", env.Users, func() error {
+		return users.Find(bson.M{"id": receiver}).One(&user)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Прерванный возврат мог уже забрать покупку
+	var revoked int
+	err = traceDB(r, "count", env.Ledger, func() (err error) {
+		revoked, err = s.DB("simple").C(env.Ledger).Find(bson.M{"user_id": receiver, "ref": orderRef(order), "reason": ledger.ReasonRefund}).Count()
+		return err
+	})
+	if err != nil || revoked > 0 {
+		return err
+	}
+
+	var entries []ledger.Entry
+	err = traceDB(r, "find", env.Ledger, func() error {
+		return s.DB("simple").C(env.Ledger).Find(bson.M{"user_id": receiver, "ref": orderRef(order), "reason": ledger.ReasonPurchase}).All(&entries)
+	})
+	if err != nil {
+		return err
+	}
+
+	effects, err := orderEffects(r, s, order)
+	if err != nil {
+		return err
+	}
+
+	saveSnapshot(r, s, env, user, snapshotRefund)
+	before := user
+	for _, it := range entries {
+		delta := it.Amount
+		if it.To == ledger.AccountUser {
+			delta = -delta
+		}
+		val := userCounter(user, it.Currency) + delta
+		if val < 0 {
+			val = 0
+		}
+		setUserCounter(&user, it.Currency, val)
+	}
+	for _, part := range order.Parts {
+		if effects[part.Item].All_ok {
+			user.AllOk = ""
+		}
+	}
+
+	err = traceDB(r, "update", env.Users, func() error {
+		return users.Update(bson.M{"id": user.ID}, &user)
+	})
+	if err != nil {
+		return err
+	}
+
+	ledgerUserChanges(r, s, env.Ledger, before, user, ledger.AccountShop, ledger.ReasonRefund, orderRef(order), "")
+	return nil
+}
+
+// retryWorker в фоне повторяет выдачу покупок по заказам grant_failed
+func retryWorker(cfg Config, s *mgo.Session) {
+	for {
+		time.Sleep(cfg.RetryInterval)
+		retryFailedOrders(cfg, s)
+	}
+}
+
+func retryFailedOrders(cfg Config, s *mgo.Session) {
+	for _, env := range []payEnv{liveEnv, sandboxEnv} {
+		retryFailedOrdersEnv(cfg, s, env)
+	}
+}
+
+func retryFailedOrdersEnv(cfg Config, s *mgo.Session, env payEnv) {
+	session := s.Copy()
+	defer session.Close()
+
+	c := session.DB("simple").C(env.Orders)
+	expireGrantLeases(session, env)
+
+	var orders []Order
+	err := c.Find(bson.M{"state": orderGrantFailed, "next_retry": bson.M{"$lte": time.Now().Unix()}}).Limit(100).All(&orders)
+	if err != nil {
+		logger.Error("retry worker", "collection", env.Orders, "err", err)
+		return
+	}
+
+	for _, order := range orders {
+		r := backgroundRequest(context.Background(), "retry-"+strconv.Itoa(order.App_order_id))
+		if grantOrder(cfg, r, session, env, order) {
+			reqLog(r).Info("grant retried", "app_order_id", order.App_order_id, "attempts", order.Attempts+1)
+		}
+	}
+}
+
+// expireGrantLeases отправляет на ручной разбор заказы, выдача которых
+// началась, но не завершилась за GrantLease (упала реплика или база)
+func expireGrantLeases(s *mgo.Session, env payEnv) {
+	c := s.DB("simple").C(env.Orders)
+
+	var orders []Order
+	err := c.Find(bson.M{"state": orderGranting, "lease_until": bson.M{"$lte": time.Now().Unix()}}).Limit(100).All(&orders)
+	if err != nil {
+		logger.Error("grant lease", "collection", env.Orders, "err", err)
+		return
+	}
+
+	for _, order := range orders {
+		r := backgroundRequest(context.Background(), "lease-"+strconv.Itoa(order.App_order_id))
+		err = setOrderState(r, c, order.App_order_id, orderGranting, orderManual, "grant lease expired", nil)
+		if err != nil && err != mgo.ErrNotFound {
+			reqLog(r).Error("order state", "app_order_id", order.App_order_id, "state", orderManual, "err", err)
+			continue
+		}
+		if err == nil {
+			reqLog(r).Warn("grant lease expired", "app_order_id", order.App_order_id)
+		}
+	}
+}
+
+// adminRetryOrder возвращает заказ needs_manual (или grant_failed) в очередь
+// retryWorker с обнуленным счетчиком попыток
+func adminRetryOrder(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		app_order_id, err := strconv.Atoi(mux.Vars(r)["app_order_id"])
+		if err != nil {
+			errorWithJSON(w, r, errParams)
+			return
+		}
+
+		c := session.DB("simple").C(liveEnv.Orders)
+
+		var order Order
+		err = traceDB(r, "find", liveEnv.Orders, func() error {
+			return c.Find(bson.M{"app_order_id": app_order_id}).One(&order)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errOrderNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+		if order.State != orderManual && order.State != orderGrantFailed {
+			errorWithJSON(w, r, errOrderState)
+			return
+		}
+
+		err = setOrderState(r, c, app_order_id, order.State, orderGrantFailed, "manual retry", bson.M{"attempts": 0, "next_retry": time.Now().Unix()})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		reqLog(r).Info("admin order retry", "app_order_id", app_order_id)
+		ResponseWithString(w, r, "ok", http.StatusOK)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	cfg := Config{RetryBase: time.Minute, RetryMax: 10 * time.Minute}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, it := range want {
+		if got := retryDelay(cfg, i+1); got != it {
+			t.Errorf("retryDelay(%d) = %s, want %s", i+1, got, it)
+		}
+	}
+}
+
+func TestGrantFailedState(t *testing.T) {
+	cfg := Config{RetryMaxAttempts: 3}
+	for attempts, want := range map[int]string{1: orderGrantFailed, 2: orderGrantFailed, 3: orderManual, 4: orderManual} {
+		if got := grantFailedState(cfg, attempts); got != want {
+			t.Errorf("grantFailedState(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestRefundStep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		order  Order
+		step   int
+		from   string
+		revoke bool
+	}{
+		{"already refunded", Order{State: orderRefunded}, refundDone, "", false},
+		{"grant in progress", Order{State: orderGranting}, refundBusy, "", false},
+		{"refund in progress", Order{State: orderRefunding, Lease_until: now.Unix() + 60, Refund_from: orderGranted}, refundBusy, "", false},
+		{"granted", Order{State: orderGranted}, refundClaim, orderGranted, true},
+		{"legacy order without state", Order{}, refundClaim, "", true},
+		{"pending", Order{State: orderPending}, refundClaim, orderPending, false},
+		{"grant failed", Order{State: orderGrantFailed}, refundClaim, orderGrantFailed, false},
+		{"needs manual", Order{State: orderManual}, refundClaim, orderManual, false},
+		{"interrupted refund of granted", Order{State: orderRefunding, Lease_until: now.Unix() - 1, Refund_from: orderGranted}, refundClaim, orderGranted, true},
+		{"interrupted refund of failed", Order{State: orderRefunding, Lease_until: now.Unix(), Refund_from: orderGrantFailed}, refundClaim, orderGrantFailed, false},
+	}
+	for _, tt := range tests {
+		step, from, revoke := refundStep(tt.order, now)
+		if step != tt.step || from != tt.from || revoke != tt.revoke {
+			t.Errorf("%s: refundStep = (%d, %q, %v), want (%d, %q, %v)", tt.name, step, from, revoke, tt.step, tt.from, tt.revoke)
+		}
+	}
+}
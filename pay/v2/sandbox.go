@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"common/ledger"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Окружение обработки платежа. В песочнице свои заказы, игроки, журнал
+// валюты, входящие, снимки и счетчик app_order_id, так что тестовые покупки
+// не трогают настоящих игроков.
+type payEnv struct {
+	Sandbox   bool
+	Orders    string //Коллекция заказов
+	Users     string //Коллекция игроков
+	Ledger    string //Журнал валюты
+	Inbox     string //Входящие
+	Snapshots string //Снимки игрока перед записью
+	Counter   string //Счетчик app_order_id в counters
+}
+
+var (
+	liveEnv    = payEnv{false, "pay", userCollection, ledger.Collection, inboxCollection, snapshotCollection, "pay"}
+	sandboxEnv = payEnv{true, "pay_test", userCollection + "_sandbox", ledger.Collection + "_sandbox", inboxCollection + "_sandbox", snapshotCollection + "_sandbox", "test"}
+)
+
+// notificationEnv выбирает окружение для уведомления VK и возвращает тип
+// уведомления без суффикса _test. В песочницу идут тестовые уведомления VK,
+// все платежи приложений из SandboxApps и платежи тестировщиков из SandboxTesters.
+func notificationEnv(cfg Config, parms map[string]string) (payEnv, string) {
+	ntype := parms["notification_type"]
+	if strings.HasSuffix(ntype, "_test") {
+		return sandboxEnv, strings.TrimSuffix(ntype, "_test")
+	}
+	for _, app_id := range cfg.SandboxApps {
+		if app_id == parms["app_id"] {
+			return sandboxEnv, ntype
+		}
+	}
+	for _, user_id := range cfg.SandboxTesters {
+		if user_id == parms["user_id"] {
+			return sandboxEnv, ntype
+		}
+	}
+	return liveEnv, ntype
+}
+
+// ensureSandboxUser заводит игрока в песочнице копией его настоящего
+// состояния (или пустым, если он еще не играл)
+func ensureSandboxUser(r *http.Request, s *mgo.Session, id string) error {
+	c := s.DB("simple").C(sandboxEnv.Users)
+
+	var count int
+	err := traceDB(r, "count", sandboxEnv.Users, func() (err error) {
+		count, err = c.Find(bson.M{"id": id}).Count()
+		return err
+	})
+	if err != nil || count > 0 {
+		return err
+	}
+
+	user := User{ID: id}
+	err = traceDB(r, "find", userCollection, func() error {
+		return s.DB("simple").C(liveEnv.Users).Find(bson.M{"id": id}).One(&user)
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	reqLog(r).Info("sandbox user created", "user_id", id, "copied", err == nil)
+	return traceDB(r, "insert", sandboxEnv.Users, func() error {
+		err := c.Insert(user)
+		if mgo.IsDup(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func ensureIndexSandbox(session *mgo.Session) {
+	index := mgo.Index{
+		Key:        []string{"id"},
+		Unique:     true,
+		Background: true,
+	}
+	err := session.DB("simple").C(sandboxEnv.Users).EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// sandboxUserHandler - состояние игрока в песочнице
+func sandboxUserHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := mux.Vars(r)["user"]
+		if _, err := strconv.Atoi(id); err != nil {
+			errorWithJSON(w, r, errParams)
+			return
+		}
+
+		var user User
+		err := traceDB(r, "find", sandboxEnv.Users, func() error {
+			return session.DB("simple").C(sandboxEnv.Users).Find(bson.M{"id": id}).One(&user)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(user, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal user", "err", err)
+		}
+		ResponseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// sandboxResetHandler удаляет игрока из песочницы вместе с его тестовыми
+// заказами, журналом и входящими. При следующей тестовой покупке он снова
+// будет скопирован из настоящего состояния.
+func sandboxResetHandler(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := mux.Vars(r)["user"]
+		vk_id, err := strconv.Atoi(id)
+		if err != nil {
+			errorWithJSON(w, r, errParams)
+			return
+		}
+
+		err = traceDB(r, "remove", sandboxEnv.Users, func() error {
+			_, err := session.DB("simple").C(sandboxEnv.Users).RemoveAll(bson.M{"id": id})
+			if err == nil {
+				_, err = session.DB("simple").C(sandboxEnv.Orders).RemoveAll(bson.M{"receiver_id": vk_id})
+			}
+			if err == nil {
+				_, err = session.DB("simple").C(sandboxEnv.Ledger).RemoveAll(bson.M{"user_id": id})
+			}
+			if err == nil {
+				_, err = session.DB("simple").C(sandboxEnv.Inbox).RemoveAll(bson.M{"user_id": id})
+			}
+			if err == nil {
+				_, err = session.DB("simple").C(sandboxEnv.Snapshots).RemoveAll(bson.M{"user_id": id})
+			}
+			return err
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		reqLog(r).Info("sandbox user reset", "user_id", id)
+		ResponseWithString(w, r, "ok", http.StatusOK)
+	}
+}
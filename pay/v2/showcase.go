@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Сколько VK может кешировать товар (expiration в ответе get_item)
+const itemExpiration = 600
+
+// Запас на задержку между созданием заказа в VK и окончанием акции
+const saleGrace = 5 * time.Minute
+
+// langChain - порядок поиска перевода: язык из запроса VK (ru_RU), его основа (ru),
+// затем запасные языки из конфига
+func langChain(cfg Config, lang string) []string {
+	chain := []string{}
+	lang = strings.ToLower(strings.Replace(lang, "-", "_", -1))
+	if lang == "" {
+		return []string{cfg.LangDefault}
+	}
+	chain = append(chain, lang)
+	if i := strings.Index(lang, "_"); i > 0 {
+		chain = append(chain, lang[:i])
+	}
+	return append(chain, cfg.LangFallback...)
+}
+
+// localized выбирает перевод по цепочке языков. Значение по умолчанию (def)
+// написано на языке cfg.LangDefault и используется, когда цепочка до него доходит.
+func localized(cfg Config, values map[string]string, chain []string, def string) string {
+	for _, lang := range chain {
+		if val, ok := values[lang]; ok && val != "" {
+			return val
+		}
+		if lang == cfg.LangDefault {
+			return def
+		}
+	}
+	return def
+}
+
+func (item Item) LocalizedTitle(cfg Config, lang string) string {
+	return localized(cfg, item.Titles, langChain(cfg, lang), item.Title)
+}
+
+func (item Item) LocalizedDescription(cfg Config, lang string) string {
+	return localized(cfg, item.Descriptions, langChain(cfg, lang), item.Description)
+}
+
+// SaleActive - действует ли акция в момент t. Sale_start и Sale_end в unix time,
+// 0 означает отсутствие ограничения с этой стороны.
+func (item Item) SaleActive(t time.Time) bool {
+	if item.Sale_price <= 0 {
+		return false
+	}
+	if item.Sale_start > 0 && t.Unix() < item.Sale_start {
+		return false
+	}
+	if item.Sale_end > 0 && t.Unix() >= item.Sale_end {
+		return false
+	}
+	return true
+}
+
+// EffectivePrice - цена для игрока, который уже купил товар по акции salesUsed раз
+func (item Item) EffectivePrice(t time.Time, salesUsed int) int {
+	if !item.SaleActive(t) {
+		return item.Price
+	}
+	if item.Sale_limit > 0 && salesUsed >= item.Sale_limit {
+		return item.Price
+	}
+	return item.Sale_price
+}
+
+// Expiration не дает VK закешировать цену дольше, чем до начала или конца акции
+func (item Item) Expiration(t time.Time) int {
+	exp := int64(itemExpiration)
+	if item.Sale_price > 0 {
+		for _, edge := range []int64{item.Sale_start, item.Sale_end} {
+			left := edge - t.Unix()
+			if left > 0 && left < exp {
+				exp = left
+			}
+		}
+	}
+	return int(exp)
+}
+
+// PriceValidAt - могла ли витрина показать цену price в момент t
+func (item Item) PriceValidAt(price int, t time.Time) bool {
+	if price == item.Price {
+		return true
+	}
+	return price == item.Sale_price && (item.SaleActive(t) || item.SaleActive(t.Add(-saleGrace)))
+}
+
+// countSales - сколько раз игрок уже купил товар по текущей акции.
+// Возвращенные покупки акцию не расходуют.
+func countSales(c *mgo.Collection, item Item, user_id int) (int, error) {
+	query := bson.M{"app_id": item.App_id, "item": item.Item, "user_id": user_id, "sale": true, "state": bson.M{"$ne": orderRefunded}}
+	if item.Sale_start > 0 {
+		query["date"] = bson.M{"$gte": item.Sale_start}
+	}
+	return c.Find(query).Count()
+}
+
+// findItem ищет товар витрины. Если товара нет, сам отвечает VK ошибкой 20.
+func findItem(w http.ResponseWriter, r *http.Request, c_showcase *mgo.Collection, app_id int, name string) (Item, bool) {
+	var item Item
+	err := traceDB(r, "find", "showcase", func() error {
+		return c_showcase.Find(bson.M{"app_id": app_id, "item": name}).One(&item)
+	})
+	if err != nil {
+		ErrorResponse(w, r, 20, "Товар не существует", true)
+		return item, false
+	}
+	return item, true
+}
+
+// checkOrderPrice сверяет цену, которую списал VK, с ценой витрины на момент заказа
+// и отмечает покупку по акции. Цена акции принимается, только пока игрок не
+// выбрал Sale_limit. При ошибке сам отвечает VK.
+func checkOrderPrice(w http.ResponseWriter, r *http.Request, c_pay *mgo.Collection, item Item, order *Order) bool {
+	price, err := strconv.Atoi(order.Item_price)
+	at := time.Unix(int64(order.Date), 0)
+	if err != nil || !item.PriceValidAt(price, at) {
+		reqLog(r).Warn("price mismatch", "item", order.Item, "item_price", order.Item_price, "price", item.Price, "sale_price", item.Sale_price)
+		ErrorResponse(w, r, 106, "Цена не совпадает с витриной", true)
+		return false
+	}
+
+	order.Sale = price == item.Sale_price && price != item.Price
+	if order.Sale && item.Sale_limit > 0 {
+		var sales int
+		err := traceDB(r, "count", c_pay.Name, func() (err error) {
+			sales, err = countSales(c_pay, item, order.User_id)
+			return err
+		})
+		if err != nil {
+			ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+			return false
+		}
+		if sales >= item.Sale_limit {
+			reqLog(r).Warn("sale limit used up", "item", order.Item, "user_id", order.User_id, "sales", sales, "sale_limit", item.Sale_limit)
+			ErrorResponse(w, r, 106, "Цена не совпадает с витриной", true)
+			return false
+		}
+	}
+	order.Amount = price
+	return true
+}
+
+// startOfDay - начало суток (по времени сервера), от которого считается Limit_daily
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// checkItemLimits проверяет ограничения товара для получателя покупки.
+// Вызывается в get_item, чтобы VK не открывал окно оплаты, и еще раз
+// в order_status_change, чтобы не списать деньги за повторную покупку.
+func checkItemLimits(w http.ResponseWriter, r *http.Request, s *mgo.Session, env payEnv, item Item, receiver_id int, now time.Time) bool {
+	if item.Limit_total <= 0 && item.Limit_daily <= 0 && !item.Unless_all_ok {
+		return true
+	}
+
+	c_pay := s.DB("simple").C(env.Orders)
+	// Возвращенные покупки лимит не занимают. needs_manual занимают: такой
+	// заказ после разбора будет выдан или возвращен
+	query := bson.M{"app_id": item.App_id, "item": item.Item, "receiver_id": receiver_id, "state": bson.M{"$ne": orderRefunded}}
+
+	if item.Unless_all_ok {
+		var user User
+		err := traceDB(r, "find", env.Users, func() error {
+			return s.DB("simple").C(env.Users).Find(bson.M{"id": strconv.Itoa(receiver_id)}).One(&user)
+		})
+		if err != nil {
+			ErrorResponse(w, r, 22, "Пользователь не существует", true)
+			return false
+		}
+		if user.AllOk == "1" {
+			ErrorResponse(w, r, 20, "Все уже разблокировано", true)
+			return false
+		}
+	}
+
+	if item.Limit_total > 0 {
+		var count int
+		err := traceDB(r, "count", env.Orders, func() (err error) {
+			count, err = c_pay.Find(query).Count()
+			return err
+		})
+		if err != nil {
+			ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+			return false
+		}
+		if count >= item.Limit_total {
+			ErrorResponse(w, r, 20, "Товар уже куплен", true)
+			return false
+		}
+	}
+
+	if item.Limit_daily > 0 {
+		query["date"] = bson.M{"$gte": startOfDay(now).Unix()}
+		var count int
+		err := traceDB(r, "count", env.Orders, func() (err error) {
+			count, err = c_pay.Find(query).Count()
+			return err
+		})
+		if err != nil {
+			ErrorResponse(w, r, 2, "Временная ошибка базы данных", true)
+			return false
+		}
+		if count >= item.Limit_daily {
+			ErrorResponse(w, r, 20, "Лимит покупок на сегодня исчерпан", true)
+			return false
+		}
+	}
+
+	return true
+}
+
+// orderParts раскладывает покупку на базовые товары. Для набора цена заказа
+// делится между частями пропорционально их обычной цене в витрине
+// (остаток от деления достается первой части).
+func orderParts(c_showcase *mgo.Collection, item Item, item_price string) []OrderPart {
+	price, _ := strconv.Atoi(item_price)
+	if len(item.Bundle) == 0 {
+		return []OrderPart{{Item: item.Item, Count: 1, Price: price}}
+	}
+
+	parts := make([]OrderPart, len(item.Bundle))
+	weights := make([]int, len(item.Bundle))
+	for i, it := range item.Bundle {
+		parts[i] = OrderPart{Item: it.Item, Count: it.Count}
+
+		weight := 1
+		var base Item
+		err := c_showcase.Find(bson.M{"app_id": item.App_id, "item": it.Item}).One(&base)
+		if err == nil && base.Price > 0 {
+			weight = base.Price
+		}
+		weights[i] = weight * it.Count
+	}
+
+	for i, it := range splitPrice(price, weights) {
+		parts[i].Price = it
+	}
+	return parts
+}
+
+// splitPrice делит цену пропорционально весам. Остаток от округления
+// достается первой части, так что сумма частей равна цене.
+func splitPrice(price int, weights []int) []int {
+	total := 0
+	for _, it := range weights {
+		total += it
+	}
+
+	prices := make([]int, len(weights))
+	rest := price
+	for i := range prices {
+		if total > 0 {
+			prices[i] = price * weights[i] / total
+		}
+		rest -= prices[i]
+	}
+	prices[0] += rest
+	return prices
+}
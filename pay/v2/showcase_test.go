@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPrice(t *testing.T) {
+	tests := []struct {
+		price   int
+		weights []int
+		want    []int
+	}{
+		{10, []int{1}, []int{10}},
+		{10, []int{1, 1}, []int{5, 5}},
+		{10, []int{1, 1, 1}, []int{4, 3, 3}},
+		{30, []int{5, 10}, []int{10, 20}},
+		{7, []int{2, 3, 5}, []int{2, 2, 3}},
+		{0, []int{3, 4}, []int{0, 0}},
+		{10, []int{0, 0}, []int{10, 0}},
+	}
+	for _, tt := range tests {
+		got := splitPrice(tt.price, tt.weights)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitPrice(%d, %v) = %v, want %v", tt.price, tt.weights, got, tt.want)
+		}
+		sum := 0
+		for _, it := range got {
+			sum += it
+		}
+		if sum != tt.price {
+			t.Errorf("splitPrice(%d, %v): parts sum to %d", tt.price, tt.weights, sum)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// vkSignature - подпись уведомления VK: md5 от склеенных "ключ=значение"
+// всех параметров, кроме sig, в порядке ключей, и секретного ключа приложения
+func vkSignature(parms map[string]string, secret string) string {
+	keys := make([]string, 0, len(parms))
+	for key := range parms {
+		if key != "sig" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key + "=" + parms[key])
+	}
+	b.WriteString(secret)
+
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// appSecret - секретный ключ приложения из VK_SECRETS ("app_id=secret")
+func appSecret(cfg Config, app_id string) string {
+	for _, it := range cfg.VKSecrets {
+		z := strings.SplitN(it, "=", 2)
+		if len(z) == 2 && strings.TrimSpace(z[0]) == app_id {
+			return strings.TrimSpace(z[1])
+		}
+	}
+	return ""
+}
+
+// checkSignature проверяет подпись уведомления. Уведомления приложений без
+// ключа в конфиге отклоняются, кроме уведомлений песочницы при VK_ALLOW_UNSIGNED
+// (проверка pay через vkfake без ключа).
+func checkSignature(cfg Config, r *http.Request, env payEnv, parms map[string]string) bool {
+	secret := appSecret(cfg, parms["app_id"])
+	if secret == "" {
+		if cfg.AllowUnsigned && env.Sandbox {
+			reqLog(r).Warn("signature check skipped", "app_id", parms["app_id"])
+			return true
+		}
+		reqLog(r).Error("no secret for app", "app_id", parms["app_id"])
+		return false
+	}
+	sig := vkSignature(parms, secret)
+	return subtle.ConstantTimeCompare([]byte(sig), []byte(parms["sig"])) == 1
+}
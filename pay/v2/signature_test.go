@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVKSignature(t *testing.T) {
+	parms := map[string]string{
+		"notification_type": "get_item",
+		"app_id":            "5900777",
+		"user_id":           "100500",
+		"item":              "buy_life_small",
+		"sig":               "ignored",
+	}
+	// md5("app_id=5900777item=buy_life_smallnotification_type=get_itemuser_id=100500secret")
+	want := "f90699d89e6a29fc3371df491cb33244"
+	if got := vkSignature(parms, "secret"); got != want {
+		t.Errorf("vkSignature = %s, want %s", got, want)
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	cfg := Config{VKSecrets: []string{"5900777=secret", " 42 = other "}}
+	signed := func(app_id string, secret string) map[string]string {
+		parms := map[string]string{"notification_type": "get_item", "app_id": app_id, "user_id": "100500", "item": "buy_life_small"}
+		parms["sig"] = vkSignature(parms, secret)
+		return parms
+	}
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		env   payEnv
+		parms map[string]string
+		ok    bool
+	}{
+		{"valid", cfg, liveEnv, signed("5900777", "secret"), true},
+		{"secret with spaces in config", cfg, liveEnv, signed("42", "other"), true},
+		{"wrong secret", cfg, liveEnv, signed("5900777", "other"), false},
+		{"no secret for app", cfg, liveEnv, signed("1", "secret"), false},
+		{"unsigned sandbox without allow", Config{}, sandboxEnv, signed("1", ""), false},
+		{"unsigned sandbox allowed", Config{AllowUnsigned: true}, sandboxEnv, signed("1", ""), true},
+		{"unsigned live with allow", Config{AllowUnsigned: true}, liveEnv, signed("1", ""), false},
+		{"allow does not skip check for known app", Config{VKSecrets: cfg.VKSecrets, AllowUnsigned: true}, sandboxEnv, signed("5900777", "other"), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		if got := checkSignature(tt.cfg, r, tt.env, tt.parms); got != tt.ok {
+			t.Errorf("%s: checkSignature = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	tampered := signed("5900777", "secret")
+	tampered["item"] = "buy_all"
+	if checkSignature(cfg, httptest.NewRequest("POST", "/", nil), liveEnv, tampered) {
+		t.Error("tampered parameters accepted")
+	}
+}
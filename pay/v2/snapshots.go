@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Снимки игрока перед записью, общие с simple (там список, сравнение и откат)
+const snapshotCollection = "user_snapshots"
+
+// Откуда взялся снимок
+const (
+	snapshotPurchase = "purchase" //выдача покупки
+	snapshotRefund   = "refund"   //возврат покупки
+)
+
+// Снимок документа игрока перед записью, как в simple
+type userSnapshot struct {
+	ID      bson.ObjectId `json:"id" bson:"_id"`
+	User_id string        `json:"user_id"`
+	Reason  string        `json:"reason"`
+	Ref     string        `json:"ref"` //request_id записи
+	Date    int64         `json:"date"`
+	User    User          `json:"user"`
+}
+
+// Сколько последних снимков хранится на игрока
+var snapshotKeep = 20
+
+func initSnapshots(cfg Config) {
+	if cfg.SnapshotKeep > 0 {
+		snapshotKeep = cfg.SnapshotKeep
+	}
+}
+
+func ensureIndexSnapshots(session *mgo.Session) {
+	for _, env := range []payEnv{liveEnv, sandboxEnv} {
+		c := session.DB("simple").C(env.Snapshots)
+		index := mgo.Index{
+			Key:        []string{"user_id", "-date"},
+			Background: true,
+		}
+		err := c.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// saveSnapshot сохраняет состояние игрока перед записью и удаляет снимки
+// сверх snapshotKeep. Ошибка не должна ломать выдачу, поэтому только в лог.
+func saveSnapshot(r *http.Request, s *mgo.Session, env payEnv, user User, reason string) {
+	c := s.DB("simple").C(env.Snapshots)
+
+	snap := userSnapshot{ID: bson.NewObjectId(), User_id: user.ID, Reason: reason,
+		Ref: requestID(r), Date: time.Now().Unix(), User: user}
+	err := traceDB(r, "insert", env.Snapshots, func() error {
+		return c.Insert(snap)
+	})
+	if err != nil {
+		reqLog(r).Error("save snapshot", "user_id", user.ID, "err", err)
+		return
+	}
+
+	var old []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err = traceDB(r, "find", env.Snapshots, func() error {
+		return c.Find(bson.M{"user_id": user.ID}).Sort("-date", "-_id").Skip(snapshotKeep).Select(bson.M{"_id": 1}).All(&old)
+	})
+	if err != nil || len(old) == 0 {
+		return
+	}
+	ids := []bson.ObjectId{}
+	for _, it := range old {
+		ids = append(ids, it.ID)
+	}
+	err = traceDB(r, "remove", env.Snapshots, func() error {
+		_, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		return err
+	})
+	if err != nil {
+		reqLog(r).Error("prune snapshots", "user_id", user.ID, "err", err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"common/ledger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/yaml.v2"
+)
+
+const achievementCollection = "user_achievements"
+
+// Достижение из каталога: открывается, когда метрика игрока дошла до Goal
+type achievement struct {
+	ID           string `json:"id" yaml:"id"`
+	Title        string `json:"title" yaml:"title"`
+	Description  string `json:"description" yaml:"description"`
+	Metric       string `json:"metric" yaml:"metric"`
+	Goal         int    `json:"goal" yaml:"goal"`
+	Reward       string `json:"reward" yaml:"reward"`             //Товар витрины в награду, пусто - без награды
+	Reward_count int    `json:"reward_count" yaml:"reward_count"` //Сколько раз применить товар, по умолчанию 1
+}
+
+// Открытое достижение игрока
+type userAchievement struct {
+	ID           bson.ObjectId `json:"-" bson:"_id"`
+	User_id      string        `json:"user_id"`
+	Achievement  string        `json:"achievement"`
+	Title        string        `json:"title" bson:"-"`
+	Description  string        `json:"description" bson:"-"`
+	Reward       string        `json:"reward"`
+	Reward_count int           `json:"reward_count"`
+	Date         int64         `json:"date"`
+}
+
+// Каталог достижений, загружается при старте
+var achievementCatalog []achievement
+
+// Метрики игрока, по которым открываются достижения
+var achievementMetrics = map[string]func(r *http.Request, s *mgo.Session, user userT) (int, error){
+	// Номер последнего пройденного уровня
+	"lvl_ok": func(r *http.Request, s *mgo.Session, user userT) (int, error) {
+		n, _ := strconv.Atoi(user.LvlOk)
+		return n, nil
+	},
+	"game_points": func(r *http.Request, s *mgo.Session, user userT) (int, error) {
+		n, _ := strconv.Atoi(user.GamePoints)
+		return n, nil
+	},
+	"levels_completed": func(r *http.Request, s *mgo.Session, user userT) (int, error) {
+		return countMetric(r, s, levelCollection, bson.M{"user_id": user.ID, "completed": true})
+	},
+	// Пройденные уровни, где подсказки не тратились ни в одной попытке
+	"levels_no_hints": func(r *http.Request, s *mgo.Session, user userT) (int, error) {
+		return countMetric(r, s, levelCollection, bson.M{"user_id": user.ID, "completed": true, "hints_fstep": 0, "hints_back": 0})
+	},
+	// Покупки, полученные игроком (свои и подарки), без возвратов
+	"purchases": func(r *http.Request, s *mgo.Session, user userT) (int, error) {
+		id, _ := strconv.Atoi(user.ID)
+		return countMetric(r, s, "pay", bson.M{"receiver_id": id, "state": bson.M{"$ne": "refunded"}})
+	},
+	"gifts_sent": func(r *http.Request, s *mgo.Session, user userT) (int, error) {
+		id, _ := strconv.Atoi(user.ID)
+		return countMetric(r, s, "pay", bson.M{"user_id": id, "gift": true, "state": bson.M{"$ne": "refunded"}})
+	},
+}
+
+func countMetric(r *http.Request, s *mgo.Session, collection string, query bson.M) (int, error) {
+	var count int
+	err := traceDB(r, "count", collection, func() (err error) {
+		count, err = s.DB("simple").C(collection).Find(query).Count()
+		return err
+	})
+	return count, err
+}
+
+// loadAchievements читает каталог достижений. Без файла достижений нет.
+func loadAchievements(path string) ([]achievement, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Achievements []achievement `yaml:"achievements"`
+	}
+	err = yaml.UnmarshalStrict(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, it := range file.Achievements {
+		switch {
+		case it.ID == "" || it.Title == "":
+			return nil, fmt.Errorf("%s: achievement #%d: id and title are required", path, i+1)
+		case seen[it.ID]:
+			return nil, fmt.Errorf("%s: duplicate achievement %s", path, it.ID)
+		case achievementMetrics[it.Metric] == nil:
+			return nil, fmt.Errorf("%s: %s: unknown metric %q", path, it.ID, it.Metric)
+		case it.Goal <= 0:
+			return nil, fmt.Errorf("%s: %s: goal must be > 0", path, it.ID)
+		case it.Reward_count < 0:
+			return nil, fmt.Errorf("%s: %s: reward_count must be >= 0", path, it.ID)
+		}
+		if it.Reward != "" && it.Reward_count == 0 {
+			file.Achievements[i].Reward_count = 1
+		}
+		seen[it.ID] = true
+	}
+	return file.Achievements, nil
+}
+
+func initAchievements(cfg Config) {
+	catalog, err := loadAchievements(cfg.AchievementsFile)
+	if err != nil {
+		logger.Error("achievements disabled", "err", err)
+		return
+	}
+	achievementCatalog = catalog
+	logger.Info("achievements loaded", "count", len(catalog))
+}
+
+func ensureIndexAchievements(session *mgo.Session) {
+	c := session.DB("simple").C(achievementCollection)
+	index := mgo.Index{
+		Key:        []string{"user_id", "achievement"},
+		Unique:     true,
+		Background: true,
+	}
+	err := c.EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func findAchievement(id string) (achievement, bool) {
+	for _, it := range achievementCatalog {
+		if it.ID == id {
+			return it, true
+		}
+	}
+	return achievement{}, false
+}
+
+// checkAchievements открывает игроку достижения, до которых он дошел,
+// выдает награды и возвращает открытые сейчас. Метрики считаются только
+// для еще закрытых достижений.
+func checkAchievements(r *http.Request, s *mgo.Session, id string) ([]userAchievement, error) {
+	unlocked := []userAchievement{}
+	if len(achievementCatalog) == 0 {
+		return unlocked, nil
+	}
+
+	c := s.DB("simple").C(achievementCollection)
+
+	var have []userAchievement
+	err := traceDB(r, "find", achievementCollection, func() error {
+		return c.Find(bson.M{"user_id": id}).All(&have)
+	})
+	if err != nil {
+		return nil, err
+	}
+	done := map[string]bool{}
+	for _, it := range have {
+		done[it.Achievement] = true
+	}
+
+	var user userT
+	err = traceDB(r, "find", userCollection, func() error {
+		return s.DB("simple").C(userCollection).Find(bson.M{"id": id}).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]int{}
+	for _, a := range achievementCatalog {
+		if done[a.ID] {
+			continue
+		}
+		value, ok := values[a.Metric]
+		if !ok {
+			value, err = achievementMetrics[a.Metric](r, s, user)
+			if err != nil {
+				return unlocked, err
+			}
+			values[a.Metric] = value
+		}
+		if value < a.Goal {
+			continue
+		}
+
+		ua := userAchievement{ID: bson.NewObjectId(), User_id: id, Achievement: a.ID,
+			Title: a.Title, Description: a.Description,
+			Reward: a.Reward, Reward_count: a.Reward_count, Date: time.Now().Unix()}
+		err = traceDB(r, "insert", achievementCollection, func() error {
+			return c.Insert(ua)
+		})
+		if mgo.IsDup(err) {
+			// Открыто параллельным запросом
+			continue
+		}
+		if err != nil {
+			return unlocked, err
+		}
+
+		reqLog(r).Info("achievement unlocked", "user_id", id, "achievement", a.ID)
+		if a.Reward != "" {
+			err = rewardAchievement(r, s, id, a)
+			if err != nil {
+				reqLog(r).Error("achievement reward", "user_id", id, "achievement", a.ID, "err", err)
+			}
+		}
+		unlocked = append(unlocked, ua)
+	}
+	return unlocked, nil
+}
+
+// rewardAchievement применяет к игроку товар-награду и пишет начисление в журнал
+func rewardAchievement(r *http.Request, s *mgo.Session, id string, a achievement) error {
+	c := s.DB("simple").C(userCollection)
+
+	var user userT
+	err := traceDB(r, "find", userCollection, func() error {
+		return c.Find(bson.M{"id": id}).One(&user)
+	})
+	if err != nil {
+		return err
+	}
+
+	effect, err := loadRewardEffect(r, s, a.Reward)
+	if err != nil {
+		return err
+	}
+
+	saveSnapshot(r, s, user, snapshotAchievement)
+	before := user
+	for i := 0; i < a.Reward_count; i++ {
+		applyItem(&user, effect)
+	}
+
+	err = traceDB(r, "update", userCollection, func() error {
+		return c.Update(bson.M{"id": id}, &user)
+	})
+	if err != nil {
+		return err
+	}
+
+	ledgerUserChanges(r, s, before, user, ledger.AccountGame, ledger.ReasonAward, "achievement:"+a.ID, "")
+	return nil
+}
+
+// triggerAchievements - проверка достижений после изменения игрока.
+// Ошибка не должна ломать основной запрос, поэтому только пишется в лог.
+func triggerAchievements(r *http.Request, s *mgo.Session, id string) {
+	_, err := checkAchievements(r, s, id)
+	if err != nil {
+		reqLog(r).Error("check achievements", "user_id", id, "err", err)
+	}
+}
+
+// userAchievements - открытые достижения игрока
+func userAchievements(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		c := session.DB("simple").C(achievementCollection)
+
+		list := []userAchievement{}
+		err := traceDB(r, "find", achievementCollection, func() error {
+			return c.Find(bson.M{"user_id": id}).Sort("date").All(&list)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get achievements", "err", err)
+			return
+		}
+		for i, it := range list {
+			if a, ok := findAchievement(it.Achievement); ok {
+				list[i].Title, list[i].Description = a.Title, a.Description
+			}
+		}
+
+		respBody, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// adminCheckAchievements - проверка достижений по запросу других сервисов
+// (pay после выдачи покупки). Отвечает только что открытыми.
+func adminCheckAchievements(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		unlocked, err := checkAchievements(r, session, id)
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed check achievements", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(unlocked, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"common/ledger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	errForbidden       = &apiError{http.StatusForbidden, "forbidden", "Forbidden"}
+	errUnknownCurrency = &apiError{http.StatusBadRequest, "unknown_currency", "Unknown currency"}
+)
+
+// adminOnly пускает только запросы с заголовком X-Admin-Token из конфига.
+// Если токен не задан, админские маршруты выключены.
+func adminOnly(cfg Config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Admin-Token")
+		if cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			reqLog(r).Warn("admin access denied", "path", r.URL.Path)
+			errorWithJSON(w, r, errForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+type grantReq struct {
+	Currency string `json:"currency"` //live_count, hint_fstep, hint_back
+	Amount   int    `json:"amount"`   //Отрицательное значение - списание
+	Reason   string `json:"reason"`   //grant (по умолчанию) или refund
+	Comment  string `json:"comment"`  //Почему, для истории
+}
+
+// adminGrant - ручное начисление или списание валюты поддержкой
+func adminGrant(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		var req grantReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Amount == 0 || req.Comment == "" {
+			errorWithJSON(w, r, errIncorrectBody)
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = ledger.ReasonGrant
+		}
+		if req.Reason != ledger.ReasonGrant && req.Reason != ledger.ReasonRefund {
+			errorWithJSON(w, r, errIncorrectBody)
+			return
+		}
+		known := false
+		for _, it := range ledger.Currencies {
+			if it == req.Currency {
+				known = true
+			}
+		}
+		if !known {
+			errorWithJSON(w, r, errUnknownCurrency)
+			return
+		}
+
+		c := session.DB("simple").C(userCollection)
+
+		var user userT
+		err = traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{"id": id}).One(&user)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		saveSnapshot(r, session, user, snapshotGrant)
+		before := user
+		setUserCounter(&user, req.Currency, userCounter(user, req.Currency)+req.Amount)
+
+		err = traceDB(r, "update", userCollection, func() error {
+			return c.Update(bson.M{"id": id}, &user)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errUpdateUser)
+			reqLog(r).Warn("failed grant", "err", err)
+			return
+		}
+
+		reqLog(r).Info("admin grant", "user_id", id, "currency", req.Currency, "amount", req.Amount, "comment", req.Comment)
+		ledgerUserChanges(r, session, before, user, ledger.AccountAdmin, req.Reason, requestID(r), req.Comment)
+
+		respBody, _ := json.Marshal(user)
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	cheatCollection     = "cheat_violations"
+	cheatFlagCollection = "cheat_flags"
+)
+
+// Что делать с записью клиента, которая нарушает правила
+const (
+	cheatLog    = "log"    //только записать нарушение
+	cheatClamp  = "clamp"  //сохранить, заменив нарушающие поля допустимыми значениями
+	cheatReject = "reject" //отказать в записи
+)
+
+var errCheatDetected = &apiError{http.StatusUnprocessableEntity, "cheat_detected", "Progress update rejected"}
+
+// Нарушение правил при записи прогресса клиентом
+type cheatViolation struct {
+	ID      bson.ObjectId `json:"id" bson:"_id"`
+	User_id string        `json:"user_id"`
+	Field   string        `json:"field"`
+	Rule    string        `json:"rule"`
+	From    string        `json:"from"`    //Значение до записи
+	To      string        `json:"to"`      //Что прислал клиент
+	Allowed string        `json:"allowed"` //Допустимое значение
+	Ref     string        `json:"ref"`     //request_id
+	Date    int64         `json:"date"`
+}
+
+type reviewReq struct {
+	Comment string `json:"comment"`
+}
+
+// Игрок, отмеченный для проверки поддержкой
+type cheatFlag struct {
+	User_id    string `json:"user_id"`
+	Violations int    `json:"violations"` //Нарушений за сутки на момент отметки
+	First      int64  `json:"first"`
+	Last       int64  `json:"last"`
+	Reviewed   bool   `json:"reviewed"`
+	Comment    string `json:"comment"`
+}
+
+func ensureIndexCheats(session *mgo.Session) {
+	index := mgo.Index{
+		Key:        []string{"user_id", "-date"},
+		Background: true,
+	}
+	err := session.DB("simple").C(cheatCollection).EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+
+	index = mgo.Index{
+		Key:        []string{"user_id"},
+		Unique:     true,
+		Background: true,
+	}
+	err = session.DB("simple").C(cheatFlagCollection).EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// checkCheats сравнивает запись клиента с текущим состоянием игрока.
+// Возвращает запись с допустимыми значениями вместо нарушающих и список нарушений.
+//   - lvl_ok растет не больше чем на CheatLevelStep за запись
+//   - game_points растут не больше чем на CheatPointsPerLevel за каждый новый уровень
+//   - подсказки клиент может только тратить, их дают покупки и награды сервера
+//   - жизни восстанавливаются в игре только до live_count_init
+//   - all_ok меняет только pay
+func checkCheats(cfg Config, before userT, after userT) (userT, []cheatViolation) {
+	fixed := after
+	violations := []cheatViolation{}
+	add := func(field string, rule string, from string, to string, allowed int) string {
+		val := strconv.Itoa(allowed)
+		violations = append(violations, cheatViolation{Field: field, Rule: rule, From: from, To: to, Allowed: val})
+		return val
+	}
+
+	lvlBefore, _ := strconv.Atoi(before.LvlOk)
+	lvlAfter, _ := strconv.Atoi(after.LvlOk)
+	if lvlAfter-lvlBefore > cfg.CheatLevelStep {
+		lvlAfter = lvlBefore + cfg.CheatLevelStep
+		fixed.LvlOk = add("lvl_ok", "level_step", before.LvlOk, after.LvlOk, lvlAfter)
+	}
+
+	levels := lvlAfter - lvlBefore
+	if levels < 1 {
+		levels = 1
+	}
+	pointsBefore, _ := strconv.Atoi(before.GamePoints)
+	pointsAfter, _ := strconv.Atoi(after.GamePoints)
+	if pointsAfter-pointsBefore > cfg.CheatPointsPerLevel*levels {
+		fixed.GamePoints = add("game_points", "points_per_level", before.GamePoints, after.GamePoints, pointsBefore+cfg.CheatPointsPerLevel*levels)
+	}
+
+	for _, currency := range []string{"hint_fstep", "hint_back"} {
+		b, a := userCounter(before, currency), userCounter(after, currency)
+		if a > b {
+			add(currency, "spend_only", strconv.Itoa(b), strconv.Itoa(a), b)
+			setUserCounter(&fixed, currency, b)
+		}
+	}
+
+	lives, maxLives := userCounter(after, "live_count"), userCounter(before, "live_count")
+	if maxLives < live_count_init {
+		maxLives = live_count_init
+	}
+	if lives > maxLives {
+		add("live_count", "live_regen", strconv.Itoa(userCounter(before, "live_count")), strconv.Itoa(lives), maxLives)
+		setUserCounter(&fixed, "live_count", maxLives)
+	}
+
+	// Пустое значение у старых игроков и "0" у новых - одно и то же
+	if (after.AllOk == "1") != (before.AllOk == "1") {
+		violations = append(violations, cheatViolation{Field: "all_ok", Rule: "server_only", From: before.AllOk, To: after.AllOk, Allowed: before.AllOk})
+		fixed.AllOk = before.AllOk
+	}
+
+	return fixed, violations
+}
+
+// recordCheats сохраняет нарушения и отмечает игрока для проверки, если за
+// сутки набралось CheatFlagThreshold нарушений. Ошибки только в лог.
+func recordCheats(cfg Config, r *http.Request, s *mgo.Session, id string, violations []cheatViolation) {
+	now := time.Now().Unix()
+	docs := []interface{}{}
+	for _, it := range violations {
+		it.ID = bson.NewObjectId()
+		it.User_id = id
+		it.Ref = requestID(r)
+		it.Date = now
+		docs = append(docs, it)
+		reqLog(r).Warn("cheat violation", "user_id", id, "field", it.Field, "rule", it.Rule, "from", it.From, "to", it.To, "mode", cfg.CheatMode)
+	}
+
+	c := s.DB("simple").C(cheatCollection)
+	err := traceDB(r, "insert", cheatCollection, func() error {
+		return c.Insert(docs...)
+	})
+	if err != nil {
+		reqLog(r).Error("record cheat violations", "user_id", id, "err", err)
+		return
+	}
+
+	if cfg.CheatFlagThreshold <= 0 {
+		return
+	}
+	var count int
+	err = traceDB(r, "count", cheatCollection, func() (err error) {
+		count, err = c.Find(bson.M{"user_id": id, "date": bson.M{"$gt": now - 24*3600}}).Count()
+		return err
+	})
+	if err != nil {
+		reqLog(r).Error("count cheat violations", "user_id", id, "err", err)
+		return
+	}
+	if count < cfg.CheatFlagThreshold {
+		return
+	}
+
+	err = traceDB(r, "update", cheatFlagCollection, func() error {
+		_, err := s.DB("simple").C(cheatFlagCollection).Upsert(bson.M{"user_id": id}, bson.M{
+			"$set":         bson.M{"violations": count, "last": now, "reviewed": false},
+			"$setOnInsert": bson.M{"first": now},
+		})
+		return err
+	})
+	if err != nil {
+		reqLog(r).Error("flag cheater", "user_id", id, "err", err)
+		return
+	}
+	reqLog(r).Warn("user flagged for review", "user_id", id, "violations", count)
+}
+
+// adminCheatFlags - игроки, отмеченные для проверки.
+// Параметр all=1 - вместе с уже проверенными.
+func adminCheatFlags(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		query := bson.M{"reviewed": false}
+		if r.URL.Query().Get("all") == "1" {
+			query = bson.M{}
+		}
+
+		c := session.DB("simple").C(cheatFlagCollection)
+
+		flags := []cheatFlag{}
+		err := traceDB(r, "find", cheatFlagCollection, func() error {
+			return c.Find(query).Sort("-last").All(&flags)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get cheat flags", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(flags, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// adminUserCheats - последние нарушения игрока
+func adminUserCheats(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		c := session.DB("simple").C(cheatCollection)
+
+		list := []cheatViolation{}
+		err := traceDB(r, "find", cheatCollection, func() error {
+			return c.Find(bson.M{"user_id": id}).Sort("-date").Limit(100).All(&list)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get cheat violations", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// adminReviewCheats снимает отметку с проверенного игрока
+func adminReviewCheats(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		var req reviewReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && err != io.EOF {
+			errorWithJSON(w, r, errIncorrectBody)
+			return
+		}
+
+		err = traceDB(r, "update", cheatFlagCollection, func() error {
+			return session.DB("simple").C(cheatFlagCollection).Update(bson.M{"user_id": id}, bson.M{"$set": bson.M{"reviewed": true, "comment": req.Comment}})
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		reqLog(r).Info("cheat flag reviewed", "user_id", id, "comment", req.Comment)
+		responseWithJSON(w, r, []byte("{\"message\":\"ok\"}"), http.StatusOK)
+	}
+}
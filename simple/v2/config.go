@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Настройки сервиса берутся из переменных окружения контейнера
+type Config struct {
+	MongoURL            string   //Строка подключения к mongodb
+	Listen              string   //Адрес, на котором слушаем http
+	LogLevel            string   //debug, info, warn, error
+	LogSyslog           string   //Адрес syslog (udp://172.17.0.1:514), пусто - писать в stdout
+	LogBodyRoutes       []string //Маршруты, для которых пишется тело запроса (только на уровне debug)
+	CorsOrigins         []string //Разрешенные Origin для браузерных запросов
+	CorsMaxAge          int      //Время кеширования preflight в секундах
+	RateLimits          []string //Лимиты запросов по маршрутам, "PUT /users/:id=10/1m:20"
+	RateStore           string   //memory - в памяти процесса, mongo - общий для реплик
+	TraceExporter       string   //otlp, stdout или пусто (трейсинг выключен)
+	AdminToken          string   //Токен для /admin, пусто - админские маршруты выключены
+	VKSecrets           []string //Секретные ключи приложений VK "app_id=secret" для проверки параметров запуска
+	AchievementsFile    string   //Каталог достижений (yaml)
+	DailyRewards        []string //Награды за дни серии входов, "buy_life_small,buy_fstep_small*2"
+	DailyUTCOffset      int      //Часовой пояс смены дня для серии, часов от UTC
+	DailyGraceHours     int      //Сколько часов после пропущенного дня серия еще не прерывается
+	SnapshotKeep        int      //Сколько снимков игрока хранить для отката
+	CheatMode           string   //Нарушения в записи клиента: log, clamp или reject, пусто - не проверять
+	CheatLevelStep      int      //На сколько уровней может вырасти lvl_ok за одну запись
+	CheatPointsPerLevel int      //Сколько очков можно набрать за уровень
+	DeleteUndoDays      int      //Сколько дней игрок может сам восстановить удаленный аккаунт
+	DeleteRetentionDays int      //Через сколько дней после удаления стираются данные
+	CheatFlagThreshold  int      //Нарушений за сутки, после которых игрок отмечается для проверки, 0 - не отмечать
+}
+
+func loadConfig() Config {
+	var cfg Config
+	cfg.MongoURL = getEnv("MONGO_URL", "mongodb://172.17.0.1:27017/simple")
+	cfg.Listen = getEnv("LISTEN", "0.0.0.0:3030")
+	cfg.LogLevel = getEnv("LOG_LEVEL", "info")
+	cfg.LogSyslog = getEnv("LOG_SYSLOG", "")
+	cfg.LogBodyRoutes = getEnvList("LOG_BODY_ROUTES", "")
+	cfg.CorsOrigins = getEnvList("CORS_ORIGINS", "https://naogames.ru,https://www.naogames.ru,https://vk.com,https://*.vk.com")
+	cfg.CorsMaxAge = getEnvInt("CORS_MAX_AGE", 600)
+	cfg.RateLimits = getEnvList("RATE_LIMITS", "PUT /users/:id=30/1m:10,POST /users=10/1m,GET /users=10/1m,POST /users/:id/levels/:level/:event=120/1m:30,POST /users/:id/daily=10/1m,POST /users/:id/snapshots/:snap/restore=5/1h")
+	cfg.RateStore = getEnv("RATE_STORE", "memory")
+	cfg.TraceExporter = getEnv("TRACE_EXPORTER", "")
+	cfg.AdminToken = getEnv("ADMIN_TOKEN", "")
+	cfg.VKSecrets = getEnvList("VK_SECRETS", "")
+	cfg.AchievementsFile = getEnv("ACHIEVEMENTS_FILE", "achievements.yaml")
+	cfg.DailyRewards = getEnvList("DAILY_REWARDS", "buy_fstep_small,buy_back_small,buy_life_small,buy_fstep_mid,buy_back_mid,buy_life_mid,buy_life_large")
+	cfg.DailyUTCOffset = getEnvInt("DAILY_UTC_OFFSET", 3)
+	cfg.DailyGraceHours = getEnvInt("DAILY_GRACE_HOURS", 0)
+	cfg.SnapshotKeep = getEnvInt("SNAPSHOT_KEEP", 20)
+	cfg.CheatMode = getEnv("CHEAT_MODE", cheatLog)
+	cfg.CheatLevelStep = getEnvInt("CHEAT_LEVEL_STEP", 3)
+	cfg.CheatPointsPerLevel = getEnvInt("CHEAT_POINTS_PER_LEVEL", 1000)
+	cfg.CheatFlagThreshold = getEnvInt("CHEAT_FLAG_THRESHOLD", 5)
+	cfg.DeleteUndoDays = getEnvInt("DELETE_UNDO_DAYS", 14)
+	cfg.DeleteRetentionDays = getEnvInt("DELETE_RETENTION_DAYS", 30)
+	return cfg
+}
+
+func getEnv(key string, def string) string {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	return val
+}
+
+func getEnvInt(key string, def int) int {
+	val, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func getEnvList(key string, def string) []string {
+	list := []string{}
+	for _, it := range strings.Split(getEnv(key, def), ",") {
+		it = strings.TrimSpace(it)
+		if it != "" {
+			list = append(list, it)
+		}
+	}
+	return list
+}
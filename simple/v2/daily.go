@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/ledger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const dailyCollection = "daily_rewards"
+
+var (
+	errAlreadyClaimed = &apiError{http.StatusConflict, "already_claimed", "Daily reward already claimed today"}
+	errDailyDisabled  = &apiError{http.StatusNotFound, "daily_disabled", "Daily rewards are not configured"}
+)
+
+// Награда за день серии: товар витрины, примененный Count раз
+type dailyReward struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+}
+
+// Серия входов игрока. Дни считаются по времени сервера (DailyUTCOffset),
+// а не по времени клиента.
+type dailyRecord struct {
+	User_id    string `json:"user_id"`
+	Streak     int    `json:"streak"`     //День серии последней полученной награды
+	Last_day   int64  `json:"last_day"`   //Номер дня последней награды (дни от 1970-01-01)
+	Last_claim int64  `json:"last_claim"` //Время последней награды
+	Total      int    `json:"total"`      //Всего получено наград
+}
+
+type dailyDay struct {
+	Day    int         `json:"day"`  //День серии
+	Date   int64       `json:"date"` //С какого момента можно получить
+	Reward dailyReward `json:"reward"`
+}
+
+type dailyState struct {
+	Streak        int          `json:"streak"`         //Текущая серия
+	Claimed_today bool         `json:"claimed_today"`  //Награда за сегодня уже получена
+	Claimed       *dailyReward `json:"claimed"`        //Награда, выданная этим запросом
+	Next_claim    int64        `json:"next_claim"`     //Когда можно получить следующую
+	Deadline      int64        `json:"deadline"`       //До какого момента серия не прервется
+	Calendar      []dailyDay   `json:"calendar"`       //Ближайшие награды, первая - следующая
+	User          *userT       `json:"user,omitempty"` //Игрок с наградой, клиент должен заменить им свою копию
+}
+
+// parseDailyRewards разбирает календарь наград вида "buy_life_small,buy_fstep_small*2"
+// (товар[*количество] на каждый день серии)
+func parseDailyRewards(list []string) []dailyReward {
+	rewards := []dailyReward{}
+	for _, it := range list {
+		reward := dailyReward{Item: it, Count: 1}
+		if i := strings.Index(it, "*"); i >= 0 {
+			n, err := strconv.Atoi(it[i+1:])
+			if err != nil || n <= 0 {
+				logger.Error("bad daily reward", "value", it)
+				continue
+			}
+			reward.Item, reward.Count = it[:i], n
+		}
+		if reward.Item == "" {
+			logger.Error("bad daily reward", "value", it)
+			continue
+		}
+		rewards = append(rewards, reward)
+	}
+	return rewards
+}
+
+func ensureIndexDaily(session *mgo.Session) {
+	c := session.DB("simple").C(dailyCollection)
+	index := mgo.Index{
+		Key:        []string{"user_id"},
+		Unique:     true,
+		Background: true,
+	}
+	err := c.EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Календарь: после последнего дня повторяется его награда
+type dailyCalendar struct {
+	Rewards []dailyReward
+	Offset  int64 //Сдвиг часового пояса в секундах
+	Grace   int64 //Сколько секунд можно опоздать после пропущенного дня
+}
+
+func newDailyCalendar(cfg Config) dailyCalendar {
+	return dailyCalendar{parseDailyRewards(cfg.DailyRewards), int64(cfg.DailyUTCOffset) * 3600, int64(cfg.DailyGraceHours) * 3600}
+}
+
+func (c dailyCalendar) day(t int64) int64 {
+	return (t + c.Offset) / 86400
+}
+
+func (c dailyCalendar) dayStart(day int64) int64 {
+	return day*86400 - c.Offset
+}
+
+func (c dailyCalendar) reward(streak int) dailyReward {
+	if streak > len(c.Rewards) {
+		streak = len(c.Rewards)
+	}
+	return c.Rewards[streak-1]
+}
+
+// deadline - до какого момента нужно получить следующую награду, чтобы серия
+// продолжилась: конец следующего дня плюс Grace
+func (c dailyCalendar) deadline(rec dailyRecord) int64 {
+	return c.dayStart(rec.Last_day+2) + c.Grace
+}
+
+// nextStreak - день серии, который получит игрок, если заберет награду в now
+func (c dailyCalendar) nextStreak(rec dailyRecord, now int64) int {
+	if rec.Streak == 0 || now >= c.deadline(rec) {
+		return 1
+	}
+	return rec.Streak + 1
+}
+
+func (c dailyCalendar) state(rec dailyRecord, now int64) dailyState {
+	var st dailyState
+	today := c.day(now)
+	st.Claimed_today = rec.Streak > 0 && rec.Last_day == today
+
+	next, from := c.nextStreak(rec, now), now
+	if st.Claimed_today {
+		next, from = rec.Streak+1, c.dayStart(today+1)
+	}
+	st.Streak = next - 1
+	if next > 1 {
+		st.Deadline = c.deadline(rec)
+	}
+	st.Next_claim = from
+
+	for i := 0; i < 7; i++ {
+		date := from
+		if i > 0 {
+			date = c.dayStart(c.day(from) + int64(i))
+		}
+		st.Calendar = append(st.Calendar, dailyDay{next + i, date, c.reward(next + i)})
+	}
+	return st
+}
+
+func loadDaily(r *http.Request, s *mgo.Session, id string) (dailyRecord, error) {
+	rec := dailyRecord{User_id: id}
+	err := traceDB(r, "find", dailyCollection, func() error {
+		return s.DB("simple").C(dailyCollection).Find(bson.M{"user_id": id}).One(&rec)
+	})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return rec, err
+}
+
+// userDaily - серия и календарь наград без получения награды
+func userDaily(cfg Config, s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	calendar := newDailyCalendar(cfg)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		if len(calendar.Rewards) == 0 {
+			errorWithJSON(w, r, errDailyDisabled)
+			return
+		}
+
+		rec, err := loadDaily(r, session, id)
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(calendar.state(rec, time.Now().Unix()), "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// claimDaily выдает награду за сегодняшний день серии, один раз в день
+func claimDaily(cfg Config, s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	calendar := newDailyCalendar(cfg)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		if len(calendar.Rewards) == 0 {
+			errorWithJSON(w, r, errDailyDisabled)
+			return
+		}
+
+		users := session.DB("simple").C(userCollection)
+
+		var user userT
+		err := traceDB(r, "find", userCollection, func() error {
+			return users.Find(bson.M{"id": id}).One(&user)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		rec, err := loadDaily(r, session, id)
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		now := time.Now().Unix()
+		today := calendar.day(now)
+		if rec.Streak > 0 && rec.Last_day == today {
+			errorWithJSON(w, r, errAlreadyClaimed)
+			return
+		}
+
+		// Запись меняется только если ее никто не успел обновить, так что
+		// параллельные запросы не выдадут награду дважды
+		prev := rec
+		rec.Streak = calendar.nextStreak(prev, now)
+		rec.Last_day = today
+		rec.Last_claim = now
+		rec.Total++
+
+		reward := calendar.reward(rec.Streak)
+		effect, err := loadRewardEffect(r, session, reward.Item)
+		if err != nil {
+			reqLog(r).Error("daily reward item", "item", reward.Item, "err", err)
+			errorWithJSON(w, r, errDailyDisabled)
+			return
+		}
+
+		c := session.DB("simple").C(dailyCollection)
+		err = traceDB(r, "update", dailyCollection, func() error {
+			if prev.Streak == 0 {
+				return c.Insert(rec)
+			}
+			return c.Update(bson.M{"user_id": id, "last_day": prev.Last_day}, rec)
+		})
+		if mgo.IsDup(err) || err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errAlreadyClaimed)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed claim daily", "err", err)
+			return
+		}
+
+		saveSnapshot(r, session, user, snapshotDaily)
+		before := user
+		for i := 0; i < reward.Count; i++ {
+			applyItem(&user, effect)
+		}
+		err = traceDB(r, "update", userCollection, func() error {
+			return users.Update(bson.M{"id": id}, &user)
+		})
+		if err != nil {
+			// Награду не выдали - возвращаем серию, чтобы игрок мог повторить.
+			// Первой награды записи до этого не было, ее нужно удалить.
+			err2 := traceDB(r, "update", dailyCollection, func() error {
+				if prev.Streak == 0 {
+					return c.Remove(bson.M{"user_id": id, "last_day": today})
+				}
+				return c.Update(bson.M{"user_id": id, "last_day": today}, prev)
+			})
+			if err2 != nil {
+				reqLog(r).Error("daily rollback", "user_id", id, "err", err2)
+			}
+			errorWithJSON(w, r, errUpdateUser)
+			reqLog(r).Warn("failed daily reward", "err", err)
+			return
+		}
+		ledgerUserChanges(r, session, before, user, ledger.AccountGame, ledger.ReasonAward, "daily:"+strconv.FormatInt(today, 10), "")
+
+		reqLog(r).Info("daily reward", "user_id", id, "streak", rec.Streak, "item", reward.Item, "count", reward.Count)
+
+		st := calendar.state(rec, now)
+		st.Claimed = &reward
+		st.User = &user
+
+		respBody, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
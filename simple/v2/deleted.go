@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"common/ledger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const deletedCollection = "users_deleted"
+
+// Состояния удаленного игрока
+const (
+	deletedState  = "deleted"  //можно восстановить
+	restoredState = "restored" //восстановлен
+	purgedState   = "purged"   //данные стерты, остались обезличенные финансовые записи
+)
+
+var (
+	errNotDeleted     = &apiError{http.StatusNotFound, "not_deleted", "No deleted user to restore"}
+	errRestoreExpired = &apiError{http.StatusGone, "restore_expired", "Restore period is over, contact support"}
+)
+
+// Удаленный игрок. Документ из users_arrows переносится сюда и хранится
+// DeleteRetentionDays, после чего персональные данные стираются, а запись
+// остается подтверждением удаления.
+type deletedUser struct {
+	ID            bson.ObjectId  `json:"id" bson:"_id"`
+	User_id       string         `json:"user_id"` //После стирания - Anon_id
+	User          *userT         `json:"user,omitempty" bson:",omitempty"`
+	State         string         `json:"state"`
+	Deleted       int64          `json:"deleted"`
+	Restore_until int64          `json:"restore_until"` //До какого момента игрок может восстановиться сам
+	Purge_after   int64          `json:"purge_after"`   //Когда стереть данные
+	Restored      int64          `json:"restored,omitempty"`
+	Purged        int64          `json:"purged,omitempty"`
+	Anon_id       string         `json:"anon_id,omitempty"` //Чем заменен игрок в журнале и заказах
+	Erased        map[string]int `json:"erased,omitempty"`  //Сколько записей стерто или обезличено по коллекциям
+	Ref           string         `json:"ref"`               //request_id удаления
+}
+
+func ensureIndexDeleted(session *mgo.Session) {
+	c := session.DB("simple").C(deletedCollection)
+	for _, key := range [][]string{{"user_id", "state"}, {"state", "purge_after"}} {
+		index := mgo.Index{
+			Key:        key,
+			Background: true,
+		}
+		err := c.EnsureIndex(index)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func findDeleted(r *http.Request, s *mgo.Session, id string) (deletedUser, error) {
+	var it deletedUser
+	err := traceDB(r, "find", deletedCollection, func() error {
+		return s.DB("simple").C(deletedCollection).Find(bson.M{"user_id": id, "state": deletedState}).Sort("-deleted").One(&it)
+	})
+	return it, err
+}
+
+// deleteUser переносит игрока в users_deleted. Покупки и журнал остаются
+// на месте до стирания.
+func deleteUser(cfg Config, s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		c := session.DB("simple").C(userCollection)
+
+		var user userT
+		err := traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{"id": id}).One(&user)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			reqLog(r).Warn("failed delete user", "user_id", id)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed delete user", "err", err)
+			return
+		}
+
+		now := time.Now()
+		deleted := deletedUser{ID: bson.NewObjectId(), User_id: id, User: &user, State: deletedState,
+			Deleted:       now.Unix(),
+			Restore_until: now.AddDate(0, 0, cfg.DeleteUndoDays).Unix(),
+			Purge_after:   now.AddDate(0, 0, cfg.DeleteRetentionDays).Unix(),
+			Ref:           requestID(r)}
+
+		// Сначала копия, потом удаление: при ошибке игрок не пропадет
+		err = traceDB(r, "insert", deletedCollection, func() error {
+			return session.DB("simple").C(deletedCollection).Insert(deleted)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDeleteUser)
+			reqLog(r).Warn("failed delete user", "err", err)
+			return
+		}
+
+		err = traceDB(r, "remove", userCollection, func() error {
+			return c.Remove(bson.M{"id": id})
+		})
+		if err != nil && err != mgo.ErrNotFound {
+			session.DB("simple").C(deletedCollection).RemoveId(deleted.ID)
+			errorWithJSON(w, r, errDeleteUser)
+			reqLog(r).Warn("failed delete user", "err", err)
+			return
+		}
+
+		reqLog(r).Info("user deleted", "user_id", id, "restore_until", deleted.Restore_until, "purge_after", deleted.Purge_after)
+
+		deleted.User = nil
+		respBody, _ := json.Marshal(deleted)
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// restoreUser возвращает удаленного игрока. Сам игрок может это сделать
+// до Restore_until, поддержка (admin) - пока данные не стерты.
+func restoreUser(s *mgo.Session, admin bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		deleted, err := findDeleted(r, session, id)
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errNotDeleted)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+		if !admin && time.Now().Unix() > deleted.Restore_until {
+			errorWithJSON(w, r, errRestoreExpired)
+			return
+		}
+
+		err = traceDB(r, "insert", userCollection, func() error {
+			return session.DB("simple").C(userCollection).Insert(deleted.User)
+		})
+		if mgo.IsDup(err) {
+			errorWithJSON(w, r, errUserExists)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errInsertUser)
+			reqLog(r).Warn("failed restore user", "err", err)
+			return
+		}
+
+		err = traceDB(r, "update", deletedCollection, func() error {
+			return session.DB("simple").C(deletedCollection).UpdateId(deleted.ID, bson.M{
+				"$set":   bson.M{"state": restoredState, "restored": time.Now().Unix()},
+				"$unset": bson.M{"user": 1},
+			})
+		})
+		if err != nil {
+			reqLog(r).Error("mark user restored", "user_id", id, "err", err)
+		}
+
+		reqLog(r).Info("user restored", "user_id", id, "admin", admin)
+
+		respBody, _ := json.Marshal(deleted.User)
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// Все данные игрока для выгрузки
+type userExport struct {
+	Exported     int64        `json:"exported"`
+	User         *userT       `json:"user"`
+	Deleted      *deletedUser `json:"deleted,omitempty"`
+	Orders       []bson.M     `json:"orders"`
+	Ledger       []bson.M     `json:"ledger"`
+	Levels       []bson.M     `json:"levels"`
+	Achievements []bson.M     `json:"achievements"`
+	Daily        []bson.M     `json:"daily"`
+	Snapshots    []bson.M     `json:"snapshots"`
+	Inbox        []bson.M     `json:"inbox"`
+}
+
+// exportUser - выгрузка всех данных игрока одним JSON файлом.
+// Работает и для удаленного, пока данные не стерты. Только для поддержки:
+// id игрока VK публичный, а запросы игроков в simple не подписаны.
+func exportUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		db := session.DB("simple")
+		export := userExport{Exported: time.Now().Unix()}
+
+		var user userT
+		err := traceDB(r, "find", userCollection, func() error {
+			return db.C(userCollection).Find(bson.M{"id": id}).One(&user)
+		})
+		if err == nil {
+			export.User = &user
+		} else if err == mgo.ErrNotFound {
+			deleted, err := findDeleted(r, session, id)
+			if err == mgo.ErrNotFound {
+				errorWithJSON(w, r, errUserNotFound)
+				return
+			}
+			if err != nil {
+				errorWithJSON(w, r, errDatabase)
+				return
+			}
+			export.User = deleted.User
+			deleted.User = nil
+			export.Deleted = &deleted
+		} else {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		vk_id, _ := strconv.Atoi(id)
+		parts := []struct {
+			collection string
+			query      bson.M
+			sort       string
+			result     *[]bson.M
+		}{
+			{"pay", bson.M{"$or": []bson.M{{"user_id": vk_id}, {"receiver_id": vk_id}}}, "date", &export.Orders},
+			{ledger.Collection, bson.M{"user_id": id}, "date", &export.Ledger},
+			{levelCollection, bson.M{"user_id": id}, "level", &export.Levels},
+			{achievementCollection, bson.M{"user_id": id}, "date", &export.Achievements},
+			{dailyCollection, bson.M{"user_id": id}, "_id", &export.Daily},
+			{snapshotCollection, bson.M{"user_id": id}, "date", &export.Snapshots},
+			{inboxCollection, bson.M{"user_id": id}, "date", &export.Inbox},
+		}
+		for _, part := range parts {
+			*part.result = []bson.M{}
+			if part.collection == "pay" && vk_id == 0 {
+				continue
+			}
+			err = traceDB(r, "find", part.collection, func() error {
+				return db.C(part.collection).Find(part.query).Sort(part.sort).Select(bson.M{"_id": 0}).All(part.result)
+			})
+			if err != nil {
+				errorWithJSON(w, r, errDatabase)
+				reqLog(r).Warn("failed export user", "collection", part.collection, "err", err)
+				return
+			}
+		}
+
+		reqLog(r).Info("user exported", "user_id", id)
+
+		respBody, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		w.Header().Set("Content-Disposition", "attachment; filename=\"user_"+url.PathEscape(id)+".json\"")
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// Шаг стирания: удалить или обезличить записи игрока в одной коллекции
+type purgeStep struct {
+	collection string
+	query      bson.M
+	update     bson.M //nil - удалить
+}
+
+// purgeUser стирает персональные данные удаленного игрока. Финансовые записи
+// (журнал валюты и заказы pay) остаются, но вместо игрока в них Anon_id.
+// Если игрок успел завести аккаунт заново, его текущие данные не трогаются,
+// стирается только копия удаленного документа.
+func purgeUser(r *http.Request, s *mgo.Session, deleted deletedUser) error {
+	db := s.DB("simple")
+	id := deleted.User_id
+	anon := "anon_" + deleted.ID.Hex()
+	erased := map[string]int{}
+
+	var count int
+	err := traceDB(r, "count", userCollection, func() (err error) {
+		count, err = db.C(userCollection).Find(bson.M{"id": id}).Count()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		vk_id, _ := strconv.Atoi(id)
+		steps := []purgeStep{
+			{snapshotCollection, bson.M{"user_id": id}, nil},
+			{levelCollection, bson.M{"user_id": id}, nil},
+			{achievementCollection, bson.M{"user_id": id}, nil},
+			{dailyCollection, bson.M{"user_id": id}, nil},
+			{inboxCollection, bson.M{"user_id": id}, nil},
+			{cheatCollection, bson.M{"user_id": id}, nil},
+			{cheatFlagCollection, bson.M{"user_id": id}, nil},
+			{userCollection + "_sandbox", bson.M{"id": id}, nil},
+			{ledger.Collection + "_sandbox", bson.M{"user_id": id}, nil},
+			{inboxCollection + "_sandbox", bson.M{"user_id": id}, nil},
+			{snapshotCollection + "_sandbox", bson.M{"user_id": id}, nil},
+			{ledger.Collection, bson.M{"user_id": id}, bson.M{"$set": bson.M{"user_id": anon}, "$unset": bson.M{"opening_key": ""}}},
+		}
+		if vk_id != 0 {
+			for _, orders := range []string{"pay", "pay_test"} {
+				steps = append(steps,
+					purgeStep{orders, bson.M{"user_id": vk_id}, bson.M{"$set": bson.M{"user_id": 0, "payer_anon_id": anon}}},
+					purgeStep{orders, bson.M{"receiver_id": vk_id}, bson.M{"$set": bson.M{"receiver_id": 0, "receiver_anon_id": anon}}})
+			}
+			steps = append(steps, purgeStep{inboxCollection, bson.M{"from_id": vk_id}, bson.M{"$set": bson.M{"from_id": 0}}})
+		}
+
+		for _, step := range steps {
+			var info *mgo.ChangeInfo
+			err := traceDB(r, "purge", step.collection, func() (err error) {
+				if step.update == nil {
+					info, err = db.C(step.collection).RemoveAll(step.query)
+				} else {
+					info, err = db.C(step.collection).UpdateAll(step.query, step.update)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			erased[step.collection] += info.Removed + info.Updated
+		}
+	}
+
+	return traceDB(r, "update", deletedCollection, func() error {
+		return db.C(deletedCollection).UpdateId(deleted.ID, bson.M{
+			"$set":   bson.M{"state": purgedState, "purged": time.Now().Unix(), "user_id": anon, "anon_id": anon, "erased": erased},
+			"$unset": bson.M{"user": 1},
+		})
+	})
+}
+
+// purgeWorker раз в час стирает данные игроков, у которых вышел срок хранения
+func purgeWorker(s *mgo.Session) {
+	for {
+		purgeDeleted(s)
+		time.Sleep(time.Hour)
+	}
+}
+
+func purgeDeleted(s *mgo.Session) {
+	session := s.Copy()
+	defer session.Close()
+
+	var list []deletedUser
+	err := session.DB("simple").C(deletedCollection).Find(bson.M{"state": deletedState, "purge_after": bson.M{"$lte": time.Now().Unix()}}).Limit(100).All(&list)
+	if err != nil {
+		logger.Error("purge worker", "err", err)
+		return
+	}
+
+	for _, it := range list {
+		r := backgroundRequest(context.Background(), "purge:"+it.ID.Hex())
+		err := purgeUser(r, session, it)
+		if err != nil {
+			reqLog(r).Error("purge user", "user_id", it.User_id, "err", err)
+			continue
+		}
+		reqLog(r).Info("user purged", "user_id", it.User_id)
+	}
+}
+
+// adminPurgeUser стирает данные удаленного игрока сразу, не дожидаясь
+// конца срока хранения (запрос игрока на удаление данных)
+func adminPurgeUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		deleted, err := findDeleted(r, session, id)
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errNotDeleted)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		err = purgeUser(r, session, deleted)
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed purge user", "err", err)
+			return
+		}
+
+		reqLog(r).Info("user purged", "user_id", id)
+		responseWithJSON(w, r, []byte("{\"message\":\"ok\"}"), http.StatusOK)
+	}
+}
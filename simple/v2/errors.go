@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Ошибка REST API: http код + машиночитаемый код для клиента
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"error_code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errIncorrectBody = &apiError{http.StatusBadRequest, "incorrect_body", "Incorrect body"}
+	errUserNotFound  = &apiError{http.StatusNotFound, "user_not_found", "User not found"}
+	errUserExists    = &apiError{http.StatusConflict, "user_exists", "User with this ID already exists"}
+	errDatabase      = &apiError{http.StatusInternalServerError, "database_error", "Database error"}
+	errInsertUser    = &apiError{http.StatusInternalServerError, "insert_failed", "Failed insert user"}
+	errUpdateUser    = &apiError{http.StatusInternalServerError, "update_failed", "Failed update user"}
+	errDeleteUser    = &apiError{http.StatusInternalServerError, "delete_failed", "Failed delete user"}
+	errRateLimited   = &apiError{http.StatusTooManyRequests, "rate_limited", "Too many requests"}
+)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const inboxCollection = "inbox"
+
+// Что получил игрок (OrderPart в pay)
+type inboxPart struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+	Price int    `json:"price"`
+}
+
+// Сообщение во входящих игрока (подарки и т.п.), пишет pay
+type inboxMessage struct {
+	ID           bson.ObjectId `json:"id" bson:"_id"`
+	User_id      string        `json:"user_id"` //Кому
+	From_id      int           `json:"from_id"` //От кого (id VK)
+	Type         string        `json:"type"`    //gift
+	Text         string        `json:"text"`
+	App_id       int           `json:"app_id"`
+	App_order_id int           `json:"app_order_id"`
+	Parts        []inboxPart   `json:"parts"`
+	Date         int64         `json:"date"`
+	Read         bool          `json:"read"`
+}
+
+var errMessageNotFound = &apiError{http.StatusNotFound, "message_not_found", "Message not found"}
+
+// userInbox - входящие игрока, новые сверху
+func userInbox(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		c := session.DB("simple").C(inboxCollection)
+
+		query := bson.M{"user_id": id}
+		if r.URL.Query().Get("unread") == "1" {
+			query["read"] = false
+		}
+
+		messages := []inboxMessage{}
+		err := traceDB(r, "find", inboxCollection, func() error {
+			return c.Find(query).Sort("-date").Limit(100).All(&messages)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get inbox", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(messages, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// readInboxMessage отмечает сообщение прочитанным
+func readInboxMessage(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		msg := pat.Param(r, "msg")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		if !bson.IsObjectIdHex(msg) {
+			errorWithJSON(w, r, errMessageNotFound)
+			return
+		}
+
+		c := session.DB("simple").C(inboxCollection)
+
+		err := traceDB(r, "update", inboxCollection, func() error {
+			return c.Update(bson.M{"_id": bson.ObjectIdHex(msg), "user_id": id}, bson.M{"$set": bson.M{"read": true}})
+		})
+		if err != nil {
+			switch err {
+			default:
+				errorWithJSON(w, r, errDatabase)
+				reqLog(r).Warn("failed read inbox message", "err", err)
+				return
+			case mgo.ErrNotFound:
+				errorWithJSON(w, r, errMessageNotFound)
+				return
+			}
+		}
+
+		responseWithJSON(w, r, []byte("{\"message\":\"ok\"}"), http.StatusOK)
+	}
+}
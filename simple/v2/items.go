@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Что дает игроку обычный товар. Таблица общая с pay (там покупки)
+// и задается в items.yaml, в базу ее пишет gamectl catalog apply.
+// Здесь она нужна для наград (достижения и т.п.), которые игрок
+// получает без покупки.
+const effectsCollection = "item_effects"
+
+const live_count_init = 5
+
+type itemEffect struct {
+	Item       string `json:"item" bson:"_id"`
+	All_ok     bool   `json:"all_ok"`     //Полная разблокировка
+	Live_count int    `json:"live_count"` //Сколько добавить жизней
+	Hint_fstep int    `json:"hint_fstep"` //Сколько добавить подсказок первого хода
+	Hint_back  int    `json:"hint_back"`  //Сколько добавить отмен хода
+	Reset      bool   `json:"reset"`      //Сброс прогресса и рейтинга
+}
+
+// loadRewardEffect - действие товара-награды. Сброс прогресса наградой не бывает.
+func loadRewardEffect(r *http.Request, s *mgo.Session, item string) (itemEffect, error) {
+	var effect itemEffect
+	err := traceDB(r, "find", effectsCollection, func() error {
+		return s.DB("simple").C(effectsCollection).FindId(item).One(&effect)
+	})
+	if err == mgo.ErrNotFound {
+		return effect, fmt.Errorf("unknown item %s", item)
+	}
+	if err != nil {
+		return effect, err
+	}
+	if effect.Reset {
+		return effect, fmt.Errorf("item %s can't be a reward", item)
+	}
+	return effect, nil
+}
+
+// checkRewardItems при старте проверяет, что награды из календаря и каталога
+// достижений есть в таблице товаров. Таблицу может обновить gamectl уже
+// после старта, поэтому только пишем в лог.
+func checkRewardItems(cfg Config, s *mgo.Session) {
+	session := s.Copy()
+	defer session.Close()
+
+	r := backgroundRequest(context.Background(), "check-rewards")
+	items := []string{}
+	for _, it := range newDailyCalendar(cfg).Rewards {
+		items = append(items, it.Item)
+	}
+	for _, it := range achievementCatalog {
+		if it.Reward != "" {
+			items = append(items, it.Reward)
+		}
+	}
+	for _, item := range items {
+		_, err := loadRewardEffect(r, session, item)
+		if err != nil {
+			logger.Error("reward item", "item", item, "err", err)
+		}
+	}
+}
+
+// applyItem применяет к игроку один базовый товар
+func applyItem(user *userT, effect itemEffect) {
+	if effect.Reset { //Сброс прогресса и рейтинга
+		user.GamePoints = "0"
+		user.LvlOk = "0"
+		user.LiveCount = strconv.Itoa(live_count_init)
+		user.PriceTime = "0"
+		user.GameLvlTry = "0"
+	}
+	if effect.All_ok { //Полная разблокировка
+		user.AllOk = "1"
+	}
+	for currency, n := range map[string]int{"live_count": effect.Live_count, "hint_fstep": effect.Hint_fstep, "hint_back": effect.Hint_back} {
+		if n != 0 {
+			setUserCounter(user, currency, userCounter(*user, currency)+n)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"common/ledger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ledgerBalance struct {
+	Currency string `json:"currency"`
+	Ledger   int    `json:"ledger"`  //Сумма по журналу
+	Entries  int    `json:"entries"` //Записей в журнале, 0 - истории еще нет
+	User     int    `json:"user"`    //Значение в документе игрока
+	Ok       bool   `json:"ok"`
+}
+
+func ensureIndexLedger(session *mgo.Session) {
+	err := ledger.EnsureIndex(session.DB("simple").C(ledger.Collection))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// userCounter - значение счетчика валюты в документе игрока
+func userCounter(user userT, currency string) int {
+	var val string
+	switch currency {
+	case "live_count":
+		val = user.LiveCount
+	case "hint_fstep":
+		val = user.HintFstep
+	case "hint_back":
+		val = user.HintBack
+	}
+	n, _ := strconv.Atoi(val)
+	return n
+}
+
+// setUserCounter записывает значение счетчика валюты в документ игрока
+func setUserCounter(user *userT, currency string, n int) {
+	val := strconv.Itoa(n)
+	switch currency {
+	case "live_count":
+		user.LiveCount = val
+	case "hint_fstep":
+		user.HintFstep = val
+	case "hint_back":
+		user.HintBack = val
+	}
+}
+
+// ledgerUserChanges пишет в журнал разницу счетчиков между двумя версиями игрока
+func ledgerUserChanges(r *http.Request, s *mgo.Session, before userT, after userT, other string, reason string, ref string, comment string) {
+	c := s.DB("simple").C(ledger.Collection)
+	for _, currency := range ledger.Currencies {
+		err := ledger.Write(r, c, after.ID, currency, userCounter(before, currency), userCounter(after, currency), other, reason, ref, comment)
+		if err != nil {
+			reqLog(r).Error("ledger write", "user_id", after.ID, "currency", currency, "err", err)
+		}
+	}
+}
+
+// ledgerClientChanges пишет в журнал изменения, которые прислал клиент игры:
+// уменьшение - трата, рост - награда в игре (например, восстановление жизней)
+func ledgerClientChanges(r *http.Request, s *mgo.Session, before userT, after userT) {
+	c := s.DB("simple").C(ledger.Collection)
+	for _, currency := range ledger.Currencies {
+		b, a := userCounter(before, currency), userCounter(after, currency)
+		reason := ledger.ReasonAward
+		if a < b {
+			reason = ledger.ReasonSpend
+		}
+		err := ledger.Write(r, c, before.ID, currency, b, a, ledger.AccountGame, reason, requestID(r), "")
+		if err != nil {
+			reqLog(r).Error("ledger write", "user_id", before.ID, "currency", currency, "err", err)
+		}
+	}
+}
+
+// ledgerSum - баланс валюты по журналу: все поступления игроку минус все списания,
+// и количество записей
+func ledgerSum(r *http.Request, c *mgo.Collection, userID string, currency string) (int, int, error) {
+	var result []struct {
+		To     string `bson:"_id"`
+		Amount int    `bson:"amount"`
+		Count  int    `bson:"count"`
+	}
+	err := traceDB(r, "aggregate", ledger.Collection, func() error {
+		return c.Pipe([]bson.M{
+			{"$match": bson.M{"user_id": userID, "currency": currency}},
+			{"$group": bson.M{"_id": bson.M{"$cond": []interface{}{bson.M{"$eq": []string{"$to", ledger.AccountUser}}, "in", "out"}}, "amount": bson.M{"$sum": "$amount"}, "count": bson.M{"$sum": 1}}},
+		}).All(&result)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sum, count := 0, 0
+	for _, it := range result {
+		count += it.Count
+		if it.To == "in" {
+			sum += it.Amount
+		} else {
+			sum -= it.Amount
+		}
+	}
+	return sum, count, nil
+}
+
+// userLedger - история операций игрока, новые сверху.
+// Параметры: currency - фильтр по валюте, limit и skip - постранично.
+func userLedger(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		query := bson.M{"user_id": id}
+		if currency := r.URL.Query().Get("currency"); currency != "" {
+			query["currency"] = currency
+		}
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 || limit > 500 {
+			limit = 100
+		}
+		skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+
+		c := session.DB("simple").C(ledger.Collection)
+
+		entries := []ledger.Entry{}
+		err = traceDB(r, "find", ledger.Collection, func() error {
+			return c.Find(query).Sort("-date", "-_id").Skip(skip).Limit(limit).All(&entries)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get ledger", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// userLedgerBalance сверяет счетчики в документе игрока с суммами по журналу
+func userLedgerBalance(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		var user userT
+		err := traceDB(r, "find", userCollection, func() error {
+			return session.DB("simple").C(userCollection).Find(bson.M{"id": id}).One(&user)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		c := session.DB("simple").C(ledger.Collection)
+
+		balances := []ledgerBalance{}
+		for _, currency := range ledger.Currencies {
+			sum, count, err := ledgerSum(r, c, id, currency)
+			if err != nil {
+				errorWithJSON(w, r, errDatabase)
+				return
+			}
+			val := userCounter(user, currency)
+			ok := count == 0 || sum == val
+			balances = append(balances, ledgerBalance{currency, sum, count, val, ok})
+			if !ok {
+				reqLog(r).Warn("ledger mismatch", "user_id", id, "currency", currency, "ledger", sum, "user", val)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(balances, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
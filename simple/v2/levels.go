@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const levelCollection = "levels"
+
+// События прохождения уровня, которые присылает клиент
+const (
+	levelStart    = "start"
+	levelFail     = "fail"
+	levelComplete = "complete"
+)
+
+var (
+	errIncorrectLevel = &apiError{http.StatusBadRequest, "incorrect_level", "Incorrect level"}
+	errLevelEvent     = &apiError{http.StatusNotFound, "unknown_event", "Unknown level event, use start, fail or complete"}
+)
+
+// Прохождение одного уровня одним игроком
+type levelProgress struct {
+	User_id        string `json:"user_id"`
+	Level          int    `json:"level"`
+	Starts         int    `json:"starts"`
+	Attempts       int    `json:"attempts"` //Законченных попыток: проигрыши и прохождения
+	Fails          int    `json:"fails"`
+	Completes      int    `json:"completes"`
+	Completed      bool   `json:"completed"`
+	Tries_to_pass  int    `json:"tries_to_pass"` //С какой попытки уровень пройден впервые
+	First_complete int64  `json:"first_complete"`
+	Best_duration  int    `json:"best_duration"`  //Лучшее время прохождения в секундах
+	Total_duration int    `json:"total_duration"` //Время во всех попытках в секундах
+	Hints_fstep    int    `json:"hints_fstep"`    //Потрачено подсказок первого хода
+	Hints_back     int    `json:"hints_back"`     //Потрачено отмен хода
+	Last_event     int64  `json:"last_event"`
+}
+
+// Тело события уровня. Для start все поля необязательны.
+type levelEventReq struct {
+	Duration    int `json:"duration"`    //Длительность попытки в секундах
+	Hints_fstep int `json:"hints_fstep"` //Подсказок первого хода за попытку
+	Hints_back  int `json:"hints_back"`  //Отмен хода за попытку
+	Attempt     int `json:"attempt"`     //Номер попытки по счетчику клиента, 0 - не передан
+}
+
+// Сложность уровня по всем игрокам
+type levelStats struct {
+	Level             int     `json:"level"`
+	Players           int     `json:"players"`   //Игроков, начинавших уровень
+	Passed            int     `json:"passed"`    //Из них прошли
+	Pass_rate         float64 `json:"pass_rate"` //Доля прошедших
+	Avg_tries         float64 `json:"avg_tries"` //Попыток до первого прохождения
+	Avg_fails         float64 `json:"avg_fails"` //Проигрышей на игрока
+	Hints_per_attempt float64 `json:"hints_per_attempt"`
+	Avg_duration      float64 `json:"avg_duration"` //Секунд на попытку
+}
+
+func ensureIndexLevels(session *mgo.Session) {
+	c := session.DB("simple").C(levelCollection)
+	index := mgo.Index{
+		Key:        []string{"user_id", "level"},
+		Unique:     true,
+		Background: true,
+	}
+	err := c.EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+
+	index = mgo.Index{
+		Key:        []string{"level"},
+		Background: true,
+	}
+	err = c.EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func validLevelEvent(req levelEventReq) bool {
+	return req.Duration >= 0 && req.Duration <= 24*3600 &&
+		req.Hints_fstep >= 0 && req.Hints_fstep <= 1000 &&
+		req.Hints_back >= 0 && req.Hints_back <= 1000 &&
+		req.Attempt >= 0
+}
+
+// levelEvent записывает начало, проигрыш или прохождение уровня
+func levelEvent(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		event := pat.Param(r, "event")
+		traceAttrs(r, attribute.String("user.id", id), attribute.String("level.event", event))
+
+		if event != levelStart && event != levelFail && event != levelComplete {
+			errorWithJSON(w, r, errLevelEvent)
+			return
+		}
+		level, err := strconv.Atoi(pat.Param(r, "level"))
+		if err != nil || level < 1 {
+			errorWithJSON(w, r, errIncorrectLevel)
+			return
+		}
+
+		// Пустое тело - событие без подробностей
+		var req levelEventReq
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if (err != nil && err != io.EOF) || !validLevelEvent(req) {
+			errorWithJSON(w, r, errIncorrectBody)
+			return
+		}
+
+		var count int
+		err = traceDB(r, "count", userCollection, func() (err error) {
+			count, err = session.DB("simple").C(userCollection).Find(bson.M{"id": id}).Count()
+			return err
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+		if count == 0 {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+
+		now := time.Now().Unix()
+		update := bson.M{"$set": bson.M{"last_event": now}}
+		inc := bson.M{}
+		switch event {
+		case levelStart:
+			inc["starts"] = 1
+		case levelFail, levelComplete:
+			inc[event+"s"] = 1
+			inc["total_duration"] = req.Duration
+			inc["hints_fstep"] = req.Hints_fstep
+			inc["hints_back"] = req.Hints_back
+			// Клиент знает номер попытки точнее: события могли потеряться
+			if req.Attempt > 0 {
+				update["$max"] = bson.M{"attempts": req.Attempt}
+			} else {
+				inc["attempts"] = 1
+			}
+		}
+		update["$inc"] = inc
+
+		c := session.DB("simple").C(levelCollection)
+
+		var progress levelProgress
+		err = traceDB(r, "update", levelCollection, func() error {
+			_, err := c.Find(bson.M{"user_id": id, "level": level}).Apply(mgo.Change{Update: update, Upsert: true, ReturnNew: true}, &progress)
+			return err
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed level event", "user_id", id, "level", level, "err", err)
+			return
+		}
+
+		if event == levelComplete {
+			sel := bson.M{"user_id": id, "level": level}
+
+			// Первое прохождение записывает только один из параллельных запросов
+			if !progress.Completed {
+				err = traceDB(r, "update", levelCollection, func() error {
+					return c.Update(bson.M{"user_id": id, "level": level, "completed": bson.M{"$ne": true}}, bson.M{"$set": bson.M{
+						"completed":      true,
+						"tries_to_pass":  progress.Attempts,
+						"first_complete": now,
+					}})
+				})
+				if err == mgo.ErrNotFound {
+					err = nil
+				}
+			}
+
+			// Лучшее время: $min, чтобы более медленная параллельная попытка его
+			// не затерла. 0 - время не было известно (старые записи)
+			if err == nil && req.Duration > 0 {
+				err = traceDB(r, "update", levelCollection, func() error {
+					err := c.Update(bson.M{"user_id": id, "level": level, "best_duration": 0}, bson.M{"$set": bson.M{"best_duration": req.Duration}})
+					if err == mgo.ErrNotFound {
+						err = c.Update(sel, bson.M{"$min": bson.M{"best_duration": req.Duration}})
+					}
+					return err
+				})
+			}
+
+			// Ответ - состояние после всех обновлений
+			if err == nil {
+				err = traceDB(r, "find", levelCollection, func() error {
+					return c.Find(sel).One(&progress)
+				})
+			}
+			if err != nil {
+				errorWithJSON(w, r, errDatabase)
+				reqLog(r).Warn("failed level event", "user_id", id, "level", level, "err", err)
+				return
+			}
+		}
+
+		if event == levelComplete {
+			triggerAchievements(r, session, id)
+		}
+
+		respBody, err := json.MarshalIndent(progress, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// userLevels - прохождение уровней игроком
+func userLevels(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		c := session.DB("simple").C(levelCollection)
+
+		levels := []levelProgress{}
+		err := traceDB(r, "find", levelCollection, func() error {
+			return c.Find(bson.M{"user_id": id}).Sort("level").All(&levels)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get levels", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(levels, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+func ratio(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(int(float64(a)/float64(b)*100+0.5)) / 100
+}
+
+// levelsStats - сложность уровней для геймдизайнеров.
+// Параметры: from и to - диапазон уровней.
+func levelsStats(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		match := bson.M{}
+		if from, err := strconv.Atoi(r.URL.Query().Get("from")); err == nil {
+			match["$gte"] = from
+		}
+		if to, err := strconv.Atoi(r.URL.Query().Get("to")); err == nil {
+			match["$lte"] = to
+		}
+		query := bson.M{}
+		if len(match) > 0 {
+			query["level"] = match
+		}
+
+		c := session.DB("simple").C(levelCollection)
+
+		var result []struct {
+			Level       int `bson:"_id"`
+			Players     int `bson:"players"`
+			Passed      int `bson:"passed"`
+			Attempts    int `bson:"attempts"`
+			Fails       int `bson:"fails"`
+			Tries       int `bson:"tries"`
+			Duration    int `bson:"duration"`
+			Hints_fstep int `bson:"hints_fstep"`
+			Hints_back  int `bson:"hints_back"`
+		}
+		err := traceDB(r, "aggregate", levelCollection, func() error {
+			return c.Pipe([]bson.M{
+				{"$match": query},
+				{"$group": bson.M{
+					"_id":         "$level",
+					"players":     bson.M{"$sum": 1},
+					"passed":      bson.M{"$sum": bson.M{"$cond": []interface{}{"$completed", 1, 0}}},
+					"attempts":    bson.M{"$sum": "$attempts"},
+					"fails":       bson.M{"$sum": "$fails"},
+					"tries":       bson.M{"$sum": "$tries_to_pass"},
+					"duration":    bson.M{"$sum": "$total_duration"},
+					"hints_fstep": bson.M{"$sum": "$hints_fstep"},
+					"hints_back":  bson.M{"$sum": "$hints_back"},
+				}},
+				{"$sort": bson.M{"_id": 1}},
+			}).All(&result)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed level stats", "err", err)
+			return
+		}
+
+		stats := []levelStats{}
+		for _, it := range result {
+			stats = append(stats, levelStats{
+				Level:             it.Level,
+				Players:           it.Players,
+				Passed:            it.Passed,
+				Pass_rate:         ratio(it.Passed, it.Players),
+				Avg_tries:         ratio(it.Tries, it.Passed),
+				Avg_fails:         ratio(it.Fails, it.Players),
+				Hints_per_attempt: ratio(it.Hints_fstep+it.Hints_back, it.Attempts),
+				Avg_duration:      ratio(it.Duration, it.Attempts),
+			})
+		}
+
+		respBody, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
@@ -5,34 +5,25 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
+	"os"
 
+	"common/middleware"
+
+	"go.opentelemetry.io/otel/attribute"
 	"goji.io"
 	"goji.io/pat"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-func responsePreflight(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Accept-Encoding, Destination, Content-Type, Content-Length")
-	w.WriteHeader(http.StatusOK)
-}
-
-func errorWithJSON(w http.ResponseWriter, r *http.Request, message string, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.WriteHeader(code)
-	fmt.Fprintf(w, "{\"message\": %q}", message)
+func errorWithJSON(w http.ResponseWriter, r *http.Request, e *apiError) {
+	respBody, _ := json.Marshal(e)
+	responseWithJSON(w, r, respBody, e.Status)
 }
 
 func responseWithJSON(w http.ResponseWriter, r *http.Request, json []byte, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 	w.WriteHeader(code)
 	w.Write(json)
 }
@@ -69,10 +60,15 @@ const userCollectionOld = "arrows_users"
 const userCollection string = "users_arrows"
 
 func main() {
-	connString := fmt.Sprintf("mongodb://172.17.0.1:27017/simple")
-	log.Println("connection string: " + connString)
+	cfg := loadConfig()
+	initLogger(cfg, "simple_v2")
+	shutdownTracing := initTracing(cfg, "simple_v2")
+	initAchievements(cfg)
+	initSnapshots(cfg)
+
+	logger.Info("connecting to mongodb", "addr", cfg.MongoURL)
 
-	session, err := mgo.Dial(connString)
+	session, err := mgo.Dial(cfg.MongoURL)
 	if err != nil {
 		panic(err)
 	}
@@ -83,21 +79,62 @@ func main() {
 	migrate(session)
 
 	ensureIndex(session)
+	checkRewardItems(cfg, session)
+
+	limit := newLimiter(cfg, session)
 
 	mux := goji.NewMux()
-	mux.HandleFunc(pat.Options("/*"), preflight(session))
 
-	mux.HandleFunc(pat.Get("/users"), allUsers(session))
-	mux.HandleFunc(pat.Post("/users"), addUser(session))
+	mux.HandleFunc(pat.Get("/users"), limit.Wrap("GET /users", nil, allUsers(session)))
+	mux.HandleFunc(pat.Post("/users"), limit.Wrap("POST /users", nil, logBody(cfg, "/users", addUser(session))))
 
 	mux.HandleFunc(pat.Get("/users/:id"), userByID(session))
-	mux.HandleFunc(pat.Put("/users/:id"), updateUser(session))
-	mux.HandleFunc(pat.Delete("/users/:id"), deleteUser(session))
+	mux.HandleFunc(pat.Put("/users/:id"), limit.Wrap("PUT /users/:id", userParam, logBody(cfg, "/users/:id", updateUser(cfg, session))))
+	mux.HandleFunc(pat.Delete("/users/:id"), deleteUser(cfg, session))
+	mux.HandleFunc(pat.Post("/users/:id/restore"), restoreUser(session, false))
+
+	mux.HandleFunc(pat.Get("/users/:id/export"), playerOnly(cfg, exportUser(session)))
+
+	mux.HandleFunc(pat.Get("/users/:id/inbox"), userInbox(session))
+	mux.HandleFunc(pat.Put("/users/:id/inbox/:msg/read"), readInboxMessage(session))
+
+	mux.HandleFunc(pat.Get("/users/:id/ledger"), userLedger(session))
+	mux.HandleFunc(pat.Get("/users/:id/ledger/balance"), userLedgerBalance(session))
+
+	mux.HandleFunc(pat.Get("/users/:id/levels"), userLevels(session))
+	mux.HandleFunc(pat.Post("/users/:id/levels/:level/:event"), limit.Wrap("POST /users/:id/levels/:level/:event", userParam, levelEvent(session)))
+
+	mux.HandleFunc(pat.Get("/users/:id/achievements"), userAchievements(session))
+
+	mux.HandleFunc(pat.Get("/users/:id/daily"), userDaily(cfg, session))
+	mux.HandleFunc(pat.Post("/users/:id/daily"), limit.Wrap("POST /users/:id/daily", userParam, claimDaily(cfg, session)))
+
+	mux.HandleFunc(pat.Get("/users/:id/snapshots"), userSnapshots(session))
+	mux.HandleFunc(pat.Get("/users/:id/snapshots/diff"), snapshotsDiff(session))
+	mux.HandleFunc(pat.Get("/users/:id/snapshots/:snap"), userSnapshotByID(session))
+	mux.HandleFunc(pat.Post("/users/:id/snapshots/:snap/restore"), limit.Wrap("POST /users/:id/snapshots/:snap/restore", userParam, restoreSnapshot(session, false)))
+
+	mux.HandleFunc(pat.Post("/admin/users/:id/grant"), adminOnly(cfg, adminGrant(session)))
+	mux.HandleFunc(pat.Post("/admin/users/:id/achievements/check"), adminOnly(cfg, adminCheckAchievements(session)))
+	mux.HandleFunc(pat.Get("/admin/levels/stats"), adminOnly(cfg, levelsStats(session)))
+	mux.HandleFunc(pat.Get("/admin/users/:id/snapshots"), adminOnly(cfg, userSnapshots(session)))
+	mux.HandleFunc(pat.Post("/admin/users/:id/snapshots/:snap/restore"), adminOnly(cfg, restoreSnapshot(session, true)))
+	mux.HandleFunc(pat.Post("/admin/users/:id/restore"), adminOnly(cfg, restoreUser(session, true)))
+	mux.HandleFunc(pat.Post("/admin/users/:id/purge"), adminOnly(cfg, adminPurgeUser(session)))
+	mux.HandleFunc(pat.Get("/admin/users/:id/export"), adminOnly(cfg, exportUser(session)))
+	mux.HandleFunc(pat.Get("/admin/cheats"), adminOnly(cfg, adminCheatFlags(session)))
+	mux.HandleFunc(pat.Get("/admin/users/:id/cheats"), adminOnly(cfg, adminUserCheats(session)))
+	mux.HandleFunc(pat.Post("/admin/users/:id/cheats/review"), adminOnly(cfg, adminReviewCheats(session)))
 
 	mux.HandleFunc(pat.Get("/healthcheck"), test(session))
 
-	log.Println("server started on port 3030")
-	http.ListenAndServe("0.0.0.0:3030", mux)
+	go purgeWorker(session)
+
+	logger.Info("server started", "addr", cfg.Listen)
+	err = http.ListenAndServe(cfg.Listen, middleware.WithTracing(middleware.WithRequestID(middleware.CORS(cfg.CorsOrigins, cfg.CorsMaxAge, mux))))
+	logger.Error("server stopped", "err", err)
+	shutdownTracing()
+	os.Exit(1)
 }
 
 func migrate(s *mgo.Session) {
@@ -112,7 +149,7 @@ func migrate(s *mgo.Session) {
 		panic(err)
 	}
 
-	log.Println("found ", len(usersOld), " users to migrate")
+	logger.Info("users to migrate", "count", len(usersOld))
 
 	users := make([]userT, len(usersOld))
 	for i, it := range usersOld {
@@ -140,9 +177,9 @@ func migrate(s *mgo.Session) {
 		err := c.Insert(it)
 		if err != nil {
 			if mgo.IsDup(err) {
-				log.Println("User with ID=" + it.ID + " already exists")
+				logger.Debug("user already migrated", "user_id", it.ID)
 			} else {
-				log.Println("Error insert user with ID=" + it.ID)
+				logger.Error("migrate user", "user_id", it.ID, "err", err)
 			}
 		}
 	}
@@ -165,12 +202,19 @@ func ensureIndex(s *mgo.Session) {
 	if err != nil {
 		panic(err)
 	}
+
+	ensureIndexLedger(session)
+	ensureIndexLevels(session)
+	ensureIndexAchievements(session)
+	ensureIndexDaily(session)
+	ensureIndexSnapshots(session)
+	ensureIndexCheats(session)
+	ensureIndexDeleted(session)
 }
 
-func preflight(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		responsePreflight(w, r)
-	}
+// userParam - идентификатор пользователя из пути запроса
+func userParam(r *http.Request) string {
+	return pat.Param(r, "id")
 }
 
 func allUsers(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
@@ -181,16 +225,18 @@ func allUsers(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 		c := session.DB("simple").C(userCollection)
 
 		var users []userT
-		err := c.Find(bson.M{}).All(&users)
+		err := traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{}).All(&users)
+		})
 		if err != nil {
-			errorWithJSON(w, r, "Database error", http.StatusOK)
-			log.Println("Failed get all users: ", err)
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get all users", "err", err)
 			return
 		}
 
 		respBody, err := json.MarshalIndent(users, "", "  ")
 		if err != nil {
-			log.Fatal(err)
+			reqLog(r).Error("marshal response", "err", err)
 		}
 
 		responseWithJSON(w, r, respBody, http.StatusOK)
@@ -206,22 +252,24 @@ func addUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&user)
 		if err != nil {
-			errorWithJSON(w, r, "Incorrect body", http.StatusBadRequest)
+			errorWithJSON(w, r, errIncorrectBody)
 			return
 		}
 
 		c := session.DB("simple").C(userCollection)
 
-		err = c.Insert(user)
+		err = traceDB(r, "insert", userCollection, func() error {
+			return c.Insert(user)
+		})
 		if err != nil {
 			if mgo.IsDup(err) {
-				errorWithJSON(w, r, "User with this ID already exists", http.StatusOK)
-				log.Println("Failed insert user: ", err)
+				errorWithJSON(w, r, errUserExists)
+				reqLog(r).Warn("failed insert user", "err", err)
 				return
 			}
 
-			errorWithJSON(w, r, "Failed insert user", http.StatusOK)
-			log.Println("Failed insert user: ", err)
+			errorWithJSON(w, r, errInsertUser)
+			reqLog(r).Warn("failed insert user", "err", err)
 			return
 		}
 
@@ -238,94 +286,120 @@ func userByID(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 		defer session.Close()
 
 		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
 
 		c := session.DB("simple").C(userCollection)
 
 		var user userT
-		err := c.Find(bson.M{"id": id}).One(&user)
+		err := traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{"id": id}).One(&user)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			reqLog(r).Warn("failed find user by id", "user_id", id)
+			return
+		}
 		if err != nil {
-			errorWithJSON(w, r, "User not found", http.StatusOK)
-			log.Println("Failed find user by ID: ", err)
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed find user by id", "err", err)
 			return
 		}
 
 		if user.ID == "" {
-			errorWithJSON(w, r, "User not found", http.StatusOK)
-			log.Println("Failed find user by ID")
+			errorWithJSON(w, r, errUserNotFound)
+			reqLog(r).Warn("failed find user by id", "user_id", id)
 			return
 		}
 
 		respBody, err := json.MarshalIndent(user, "", "  ")
 		if err != nil {
-			log.Fatal(err)
+			reqLog(r).Error("marshal response", "err", err)
 		}
 
 		responseWithJSON(w, r, respBody, http.StatusOK)
 	}
 }
 
-func updateUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+func updateUser(cfg Config, s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session := s.Copy()
 		defer session.Close()
 
 		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
 
 		var user userT
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&user)
 		if err != nil {
-			errorWithJSON(w, r, "Incorrect body", http.StatusBadRequest)
+			errorWithJSON(w, r, errIncorrectBody)
 			return
 		}
 
 		c := session.DB("simple").C(userCollection)
 
-		err = c.Update(bson.M{"id": id}, &user)
+		var before userT
+		err = traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{"id": id}).One(&before)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			reqLog(r).Warn("failed update user", "user_id", id)
+			return
+		}
 		if err != nil {
-			switch err {
-			default:
-				errorWithJSON(w, r, "Failed update user", http.StatusOK)
-				log.Println("Failed update user: ", err)
-				return
-			case mgo.ErrNotFound:
-				errorWithJSON(w, r, "User not found", http.StatusOK)
-				log.Println("Failed update user")
-				return
-			}
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed update user", "err", err)
+			return
 		}
 
-		// Marshal provided interface into JSON structure
-		respBody, _ := json.Marshal(user)
-		w.Header().Set("Location", r.URL.Path+"/"+user.ID)
-		responseWithJSON(w, r, respBody, http.StatusCreated)
-	}
-}
-
-func deleteUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		id := pat.Param(r, "id")
+		if cfg.CheatMode != "" {
+			fixed, violations := checkCheats(cfg, before, user)
+			if len(violations) > 0 {
+				recordCheats(cfg, r, session, id, violations)
+				switch cfg.CheatMode {
+				case cheatReject:
+					errorWithJSON(w, r, errCheatDetected)
+					return
+				case cheatClamp:
+					user = fixed
+				}
+			}
+		}
 
-		c := session.DB("simple").C(userCollection)
+		saveSnapshot(r, session, before, snapshotClient)
 
-		err := c.Remove(bson.M{"id": id})
+		err = traceDB(r, "update", userCollection, func() error {
+			return c.Update(bson.M{"id": id}, &user)
+		})
 		if err != nil {
 			switch err {
 			default:
-				errorWithJSON(w, r, "Failed delete user", http.StatusOK)
-				log.Println("Failed delete user: ", err)
+				errorWithJSON(w, r, errUpdateUser)
+				reqLog(r).Warn("failed update user", "err", err)
 				return
 			case mgo.ErrNotFound:
-				errorWithJSON(w, r, "User not found", http.StatusOK)
-				log.Println("Failed delete user")
+				errorWithJSON(w, r, errUserNotFound)
+				reqLog(r).Warn("failed update user", "user_id", id)
 				return
 			}
 		}
 
-		responseWithJSON(w, r, []byte("{\"message\":\"ok\"}"), http.StatusOK)
+		ledgerClientChanges(r, session, before, user)
+		triggerAchievements(r, session, id)
+
+		// Награды за достижения уже записаны в игрока: клиент должен получить
+		// их в ответе, иначе следующий PUT затрет их старыми значениями
+		err = traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{"id": id}).One(&user)
+		})
+		if err != nil {
+			reqLog(r).Warn("failed reload user", "user_id", id, "err", err)
+		}
+
+		// Marshal provided interface into JSON structure
+		respBody, _ := json.Marshal(user)
+		responseWithJSON(w, r, respBody, http.StatusOK)
 	}
 }
 
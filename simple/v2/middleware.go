@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"common/middleware"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/mgo.v2"
+)
+
+// Лог запросов, CORS, лимиты и трейсинг общие с pay и лежат в
+// common/middleware. Здесь они связываются с конфигом и ошибками сервиса.
+
+var logger = middleware.Logger()
+
+func initLogger(cfg Config, service string) {
+	logger = middleware.InitLogger(cfg.LogLevel, cfg.LogSyslog, service)
+}
+
+func initTracing(cfg Config, service string) func() {
+	return middleware.InitTracing(cfg.TraceExporter, service)
+}
+
+func reqLog(r *http.Request) *slog.Logger {
+	return middleware.ReqLog(r)
+}
+
+func requestID(r *http.Request) string {
+	return middleware.RequestID(r)
+}
+
+func backgroundRequest(ctx context.Context, id string) *http.Request {
+	return middleware.BackgroundRequest(ctx, id)
+}
+
+func traceDB(r *http.Request, op string, collection string, f func() error) error {
+	return middleware.TraceDB(r, op, collection, f)
+}
+
+func traceAttrs(r *http.Request, attrs ...attribute.KeyValue) {
+	middleware.TraceAttrs(r, attrs...)
+}
+
+func logBody(cfg Config, route string, h http.HandlerFunc) http.HandlerFunc {
+	return middleware.LogBody(cfg.LogBodyRoutes, route, h)
+}
+
+func newLimiter(cfg Config, s *mgo.Session) *middleware.Limiter {
+	return middleware.NewLimiter(cfg.RateLimits, cfg.RateStore, s, func(w http.ResponseWriter, r *http.Request) {
+		errorWithJSON(w, r, errRateLimited)
+	})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"common/ledger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const snapshotCollection = "user_snapshots"
+
+// Откуда взялся снимок: какая запись затерла это состояние игрока
+const (
+	snapshotClient      = "client"      //PUT /users/:id
+	snapshotGrant       = "grant"       //ручное начисление поддержки
+	snapshotDaily       = "daily"       //ежедневная награда
+	snapshotAchievement = "achievement" //награда за достижение
+	snapshotRestore     = "restore"     //восстановление из снимка
+	snapshotPurchase    = "purchase"    //выдача покупки (pay)
+	snapshotRefund      = "refund"      //возврат покупки (pay)
+)
+
+var errSnapshotNotFound = &apiError{http.StatusNotFound, "snapshot_not_found", "Snapshot not found"}
+
+// Снимок документа игрока перед записью
+type userSnapshot struct {
+	ID      bson.ObjectId `json:"id" bson:"_id"`
+	User_id string        `json:"user_id"`
+	Reason  string        `json:"reason"`
+	Ref     string        `json:"ref"` //request_id записи
+	Date    int64         `json:"date"`
+	User    userT         `json:"user"`
+}
+
+type snapshotDiff struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type restoreReq struct {
+	Comment string `json:"comment"`
+}
+
+// Сколько последних снимков хранится на игрока
+var snapshotKeep = 20
+
+func initSnapshots(cfg Config) {
+	if cfg.SnapshotKeep > 0 {
+		snapshotKeep = cfg.SnapshotKeep
+	}
+}
+
+func ensureIndexSnapshots(session *mgo.Session) {
+	c := session.DB("simple").C(snapshotCollection)
+	index := mgo.Index{
+		Key:        []string{"user_id", "-date"},
+		Background: true,
+	}
+	err := c.EnsureIndex(index)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// saveSnapshot сохраняет состояние игрока перед записью и удаляет снимки
+// сверх snapshotKeep. Ошибка не должна ломать запись, поэтому только в лог.
+func saveSnapshot(r *http.Request, s *mgo.Session, user userT, reason string) {
+	c := s.DB("simple").C(snapshotCollection)
+
+	snap := userSnapshot{ID: bson.NewObjectId(), User_id: user.ID, Reason: reason,
+		Ref: requestID(r), Date: time.Now().Unix(), User: user}
+	err := traceDB(r, "insert", snapshotCollection, func() error {
+		return c.Insert(snap)
+	})
+	if err != nil {
+		reqLog(r).Error("save snapshot", "user_id", user.ID, "err", err)
+		return
+	}
+
+	var old []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err = traceDB(r, "find", snapshotCollection, func() error {
+		return c.Find(bson.M{"user_id": user.ID}).Sort("-date", "-_id").Skip(snapshotKeep).Select(bson.M{"_id": 1}).All(&old)
+	})
+	if err != nil || len(old) == 0 {
+		return
+	}
+	ids := []bson.ObjectId{}
+	for _, it := range old {
+		ids = append(ids, it.ID)
+	}
+	err = traceDB(r, "remove", snapshotCollection, func() error {
+		_, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		return err
+	})
+	if err != nil {
+		reqLog(r).Error("prune snapshots", "user_id", user.ID, "err", err)
+	}
+}
+
+func findSnapshot(r *http.Request, s *mgo.Session, id string, snap string) (userSnapshot, error) {
+	var it userSnapshot
+	if !bson.IsObjectIdHex(snap) {
+		return it, mgo.ErrNotFound
+	}
+	err := traceDB(r, "find", snapshotCollection, func() error {
+		return s.DB("simple").C(snapshotCollection).Find(bson.M{"_id": bson.ObjectIdHex(snap), "user_id": id}).One(&it)
+	})
+	return it, err
+}
+
+// diffUsers - поля, которые отличаются в двух версиях игрока
+func diffUsers(from userT, to userT) []snapshotDiff {
+	diff := []snapshotDiff{}
+	a, b := reflect.ValueOf(from), reflect.ValueOf(to)
+	for i := 0; i < a.NumField(); i++ {
+		if a.Field(i).String() != b.Field(i).String() {
+			field := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+			diff = append(diff, snapshotDiff{field, a.Field(i).String(), b.Field(i).String()})
+		}
+	}
+	return diff
+}
+
+// userSnapshots - история снимков игрока, новые первыми
+func userSnapshots(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		c := session.DB("simple").C(snapshotCollection)
+
+		list := []userSnapshot{}
+		err := traceDB(r, "find", snapshotCollection, func() error {
+			return c.Find(bson.M{"user_id": id}).Sort("-date", "-_id").All(&list)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			reqLog(r).Warn("failed get snapshots", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// userSnapshotByID - один снимок
+func userSnapshotByID(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		snap, err := findSnapshot(r, session, id, pat.Param(r, "snap"))
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errSnapshotNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(snap, "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// snapshotsDiff - отличия между двумя снимками.
+// Параметры: from и to - id снимков, to по умолчанию - текущее состояние игрока.
+func snapshotsDiff(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		load := func(snap string) (userT, *apiError) {
+			if snap == "" || snap == "current" {
+				var user userT
+				err := traceDB(r, "find", userCollection, func() error {
+					return session.DB("simple").C(userCollection).Find(bson.M{"id": id}).One(&user)
+				})
+				if err == mgo.ErrNotFound {
+					return user, errUserNotFound
+				}
+				if err != nil {
+					return user, errDatabase
+				}
+				return user, nil
+			}
+			it, err := findSnapshot(r, session, id, snap)
+			if err == mgo.ErrNotFound {
+				return it.User, errSnapshotNotFound
+			}
+			if err != nil {
+				return it.User, errDatabase
+			}
+			return it.User, nil
+		}
+
+		query := r.URL.Query()
+		if query.Get("from") == "" {
+			errorWithJSON(w, r, errSnapshotNotFound)
+			return
+		}
+		from, e := load(query.Get("from"))
+		if e != nil {
+			errorWithJSON(w, r, e)
+			return
+		}
+		to, e := load(query.Get("to"))
+		if e != nil {
+			errorWithJSON(w, r, e)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(diffUsers(from, to), "", "  ")
+		if err != nil {
+			reqLog(r).Error("marshal response", "err", err)
+		}
+
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
+
+// restoreSnapshot возвращает игрока к снимку. Текущее состояние перед этим
+// тоже сохраняется снимком, так что восстановление можно отменить.
+// Игрок восстанавливает только прогресс: валюта и покупки остаются текущими,
+// иначе откатом можно вернуть потраченное. Поддержка (full) восстанавливает
+// документ целиком, разница валюты пишется в журнал.
+func restoreSnapshot(s *mgo.Session, full bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.Copy()
+		defer session.Close()
+
+		id := pat.Param(r, "id")
+		traceAttrs(r, attribute.String("user.id", id))
+
+		var req restoreReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && err != io.EOF {
+			errorWithJSON(w, r, errIncorrectBody)
+			return
+		}
+
+		snap, err := findSnapshot(r, session, id, pat.Param(r, "snap"))
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errSnapshotNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		c := session.DB("simple").C(userCollection)
+
+		var before userT
+		err = traceDB(r, "find", userCollection, func() error {
+			return c.Find(bson.M{"id": id}).One(&before)
+		})
+		if err == mgo.ErrNotFound {
+			errorWithJSON(w, r, errUserNotFound)
+			return
+		}
+		if err != nil {
+			errorWithJSON(w, r, errDatabase)
+			return
+		}
+
+		user := snap.User
+		user.ID = id
+		if !full {
+			for _, currency := range ledger.Currencies {
+				setUserCounter(&user, currency, userCounter(before, currency))
+			}
+			user.AllOk = before.AllOk
+		}
+
+		saveSnapshot(r, session, before, snapshotRestore)
+
+		err = traceDB(r, "update", userCollection, func() error {
+			return c.Update(bson.M{"id": id}, &user)
+		})
+		if err != nil {
+			errorWithJSON(w, r, errUpdateUser)
+			reqLog(r).Warn("failed restore snapshot", "err", err)
+			return
+		}
+
+		reqLog(r).Info("snapshot restored", "user_id", id, "snapshot", snap.ID.Hex(), "full", full, "comment", req.Comment)
+		if full {
+			ledgerUserChanges(r, session, before, user, ledger.AccountAdmin, ledger.ReasonRestore, "snapshot:"+snap.ID.Hex(), req.Comment)
+		}
+
+		respBody, _ := json.Marshal(user)
+		responseWithJSON(w, r, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"goji.io/pat"
+)
+
+// Параметры запуска мини-приложения VK (vk_user_id, vk_app_id, ..., sign)
+// клиент передает как получил, строкой запроса, в заголовке X-VK-Launch-Params.
+// По ним игрок подтверждает, что обращается к своим данным.
+const vkLaunchParamsHeader = "X-VK-Launch-Params"
+
+var errUnauthorized = &apiError{http.StatusUnauthorized, "unauthorized", "VK launch params are missing or invalid"}
+
+// vkLaunchSign - подпись параметров запуска: HMAC-SHA256 секретным ключом
+// приложения от параметров vk_*, отсортированных по ключу и склеенных как
+// строка запроса, в base64url без '='
+func vkLaunchSign(query url.Values, secret string) string {
+	parms := url.Values{}
+	for key, values := range query {
+		if strings.HasPrefix(key, "vk_") && len(values) > 0 {
+			parms.Set(key, values[0])
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parms.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// appSecret - секретный ключ приложения из VK_SECRETS ("app_id=secret")
+func appSecret(cfg Config, app_id string) string {
+	for _, it := range cfg.VKSecrets {
+		z := strings.SplitN(it, "=", 2)
+		if len(z) == 2 && strings.TrimSpace(z[0]) == app_id {
+			return strings.TrimSpace(z[1])
+		}
+	}
+	return ""
+}
+
+// launchUser проверяет подпись параметров запуска и возвращает vk_user_id.
+// Приложения без ключа в конфиге не принимаются.
+func launchUser(cfg Config, raw string) (string, bool) {
+	query, err := url.ParseQuery(raw)
+	if err != nil {
+		return "", false
+	}
+	secret := appSecret(cfg, query.Get("vk_app_id"))
+	if secret == "" || query.Get("vk_user_id") == "" {
+		return "", false
+	}
+	sign := vkLaunchSign(query, secret)
+	if subtle.ConstantTimeCompare([]byte(sign), []byte(query.Get("sign"))) != 1 {
+		return "", false
+	}
+	return query.Get("vk_user_id"), true
+}
+
+// playerOnly пускает только самого игрока :id по подписанным параметрам запуска VK
+func playerOnly(cfg Config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := launchUser(cfg, r.Header.Get(vkLaunchParamsHeader))
+		if !ok {
+			reqLog(r).Warn("vk launch params rejected", "path", r.URL.Path)
+			errorWithJSON(w, r, errUnauthorized)
+			return
+		}
+		if user != pat.Param(r, "id") {
+			reqLog(r).Warn("player access denied", "path", r.URL.Path, "vk_user_id", user)
+			errorWithJSON(w, r, errForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func signedLaunchParams(secret string, parms url.Values) string {
+	parms.Set("sign", vkLaunchSign(parms, secret))
+	return parms.Encode()
+}
+
+func TestLaunchUser(t *testing.T) {
+	cfg := Config{VKSecrets: []string{"5900777=secret"}}
+	parms := func() url.Values {
+		return url.Values{
+			"vk_user_id":  {"100500"},
+			"vk_app_id":   {"5900777"},
+			"vk_ts":       {"1700000000"},
+			"vk_platform": {"mobile_web"},
+			"utm_source":  {"catalog"}, //не vk_* и в подпись не входит
+		}
+	}
+
+	user, ok := launchUser(cfg, signedLaunchParams("secret", parms()))
+	if !ok || user != "100500" {
+		t.Fatalf("valid params: got %q, %v", user, ok)
+	}
+
+	raw := signedLaunchParams("secret", parms())
+	tampered, _ := url.ParseQuery(raw)
+	tampered.Set("vk_user_id", "1")
+	if _, ok := launchUser(cfg, tampered.Encode()); ok {
+		t.Error("params with changed vk_user_id accepted")
+	}
+
+	if _, ok := launchUser(cfg, signedLaunchParams("other", parms())); ok {
+		t.Error("params signed with another secret accepted")
+	}
+
+	other := parms()
+	other.Set("vk_app_id", "1")
+	if _, ok := launchUser(cfg, signedLaunchParams("secret", other)); ok {
+		t.Error("params of an app without secret accepted")
+	}
+
+	if _, ok := launchUser(Config{}, raw); ok {
+		t.Error("params accepted without VK_SECRETS")
+	}
+}
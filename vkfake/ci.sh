@@ -0,0 +1,53 @@
+#!/bin/bash
+# Проверка покупок pay через vkfake без сети: mongodb, витрина из
+# gamectl/items.yaml, тестовый игрок, pay и все сценарии vkfake.
+#
+#   vkfake/ci.sh
+#
+# Нужен только docker. Код выхода vkfake - код выхода скрипта.
+set -euo pipefail
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+name=vkfake-ci-$$
+app=5900777
+secret=ci-secret
+user=100500
+
+cleanup() {
+	if [ $? -ne 0 ]; then
+		docker logs $name-pay >&2 2>/dev/null || true
+	fi
+	docker rm -f $name-mongo $name-pay >/dev/null 2>&1 || true
+	docker network rm $name >/dev/null 2>&1 || true
+}
+trap cleanup EXIT
+
+docker network create $name >/dev/null
+docker run -d --name $name-mongo --network $name -e AUTH=no tutum/mongodb >/dev/null
+
+docker build -q -t $name-gamectl "$root/gamectl" >/dev/null
+docker build -q -t $name-pay -f "$root/pay/v2/Dockerfile" "$root" >/dev/null
+docker build -q -t $name-vkfake "$root/vkfake" >/dev/null
+
+mongo=mongodb://$name-mongo:27017/simple
+for i in $(seq 1 30); do
+	docker exec $name-mongo mongo --quiet --eval 'db.version()' >/dev/null 2>&1 && break
+	sleep 1
+done
+
+docker run --rm --network $name $name-gamectl catalog apply -f items.yaml -mongo $mongo
+# В песочницу pay копирует настоящего игрока при первой тестовой покупке
+docker exec $name-mongo mongo --quiet simple --eval \
+	"db.users_arrows.insert({id: '$user', lvlok: '0', allok: '0', hintfstep: '0', hintback: '0', livecount: '5'})" >/dev/null
+
+docker run -d --name $name-pay --network $name \
+	-e MONGO_URL=$mongo -e VK_SECRETS=$app=$secret -e LOG_LEVEL=warn \
+	$name-pay >/dev/null
+
+for i in $(seq 1 30); do
+	docker run --rm --network $name --entrypoint curl curlimages/curl -sf http://$name-pay:8000/healthcheck >/dev/null 2>&1 && break
+	sleep 1
+done
+
+docker run --rm --network $name $name-vkfake \
+	-url http://$name-pay:8000/ -app $app -secret $secret -user $user
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vkfake - платформа платежей VK для проверки pay без сети: шлет подписанные
+// уведомления get_item и order_status_change, повторы, возвраты и обрывы
+// соединения и проверяет ответы по контракту callback VK.
+//
+//	vkfake -url http://localhost:8000/ -app 123 -secret key -user 1 [-run purchase,retry]
+//
+// Код выхода 1, если хоть один сценарий не прошел.
+
+var errSkipped = errors.New("skipped")
+
+func main() {
+	var p platform
+	var b purchase
+	flag.StringVar(&p.URL, "url", "http://localhost:8000/", "pay callback url")
+	flag.IntVar(&p.App_id, "app", 0, "VK app_id")
+	flag.StringVar(&p.Secret, "secret", "", "app secret key (same as VK_SECRETS in pay)")
+	flag.BoolVar(&p.Test, "test", true, "send test notifications (get_item_test, order_status_change_test)")
+	flag.DurationVar(&p.Deadline, "deadline", 5*time.Second, "how long VK waits for an answer")
+	flag.IntVar(&b.User_id, "user", 0, "payer VK id")
+	flag.IntVar(&b.Receiver_id, "receiver", 0, "receiver VK id (payer by default)")
+	flag.StringVar(&b.Item, "item", "buy_life_small", "showcase item")
+	flag.StringVar(&b.Lang, "lang", "ru_RU", "user language")
+	run := flag.String("run", "", "comma separated scenarios (all by default)")
+	flag.Parse()
+
+	if p.App_id == 0 || b.User_id == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if b.Receiver_id == 0 {
+		b.Receiver_id = b.User_id
+	}
+	p.client = &http.Client{Timeout: 2 * p.Deadline}
+
+	selected := map[string]bool{}
+	for _, name := range strings.Split(*run, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+
+	failed := 0
+	for _, sc := range scenarios {
+		if len(selected) > 0 && !selected[sc.Name] {
+			continue
+		}
+		start := time.Now()
+		err := sc.Run(&p, b)
+		switch err {
+		case nil:
+			fmt.Printf("PASS  %-14s %v\n", sc.Name, time.Since(start).Round(time.Millisecond))
+		case errSkipped:
+			fmt.Printf("SKIP  %s\n", sc.Name)
+		default:
+			failed++
+			fmt.Printf("FAIL  %-14s %v\n", sc.Name, err)
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Параметры покупки в сценариях
+type purchase struct {
+	User_id     int
+	Receiver_id int
+	Item        string
+	Lang        string
+}
+
+type scenario struct {
+	Name string
+	Run  func(p *platform, b purchase) error
+}
+
+var scenarios = []scenario{
+	{"purchase", scenarioPurchase},
+	{"retry", scenarioRetry},
+	{"refund", scenarioRefund},
+	{"timeout", scenarioTimeout},
+	{"unknown_item", scenarioUnknownItem},
+	{"bad_signature", scenarioBadSignature},
+}
+
+func expectOK(step string, e *vkError, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s: %v", step, err)
+	}
+	if e != nil {
+		return fmt.Errorf("%s: error %d %q", step, e.Error_code, e.Error_msg)
+	}
+	return nil
+}
+
+// buy проходит покупку как VK: get_item, затем оплата по цене из ответа
+func buy(p *platform, b purchase) (order_id int, item itemResp, order orderResp, err error) {
+	item, e, err := p.sendItem(p.getItem(b.User_id, b.Receiver_id, b.Item, b.Lang))
+	if err = expectOK("get_item", e, err); err != nil {
+		return
+	}
+
+	order_id = newOrderID()
+	order, e, err = p.sendOrder(p.orderStatusChange(order_id, b.User_id, b.Receiver_id, item, b.Item, "chargeable"), 0)
+	err = expectOK("order_status_change", e, err)
+	return
+}
+
+func scenarioPurchase(p *platform, b purchase) error {
+	_, _, _, err := buy(p, b)
+	return err
+}
+
+// VK повторяет уведомление, если не дождался ответа. Повтор должен
+// получить тот же app_order_id, а не вторую выдачу покупки.
+func scenarioRetry(p *platform, b purchase) error {
+	order_id, item, first, err := buy(p, b)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		again, e, err := p.sendOrder(p.orderStatusChange(order_id, b.User_id, b.Receiver_id, item, b.Item, "chargeable"), 0)
+		if err = expectOK("retry", e, err); err != nil {
+			return err
+		}
+		if again.App_order_id != first.App_order_id {
+			return fmt.Errorf("retry got app_order_id %d, first answer was %d", again.App_order_id, first.App_order_id)
+		}
+	}
+	return nil
+}
+
+// VK может прислать возврат несколько раз, в том числе одновременно.
+// Покупка должна забираться ровно один раз: в песочнице баланс игрока
+// после всех возвратов равен балансу до покупки.
+func scenarioRefund(p *platform, b purchase) error {
+	balance := func() (int, error) { return 0, nil }
+	if p.Test {
+		balance = func() (int, error) { return p.sandboxBalance(b.Receiver_id) }
+	}
+	before, err := balance()
+	if err == errNoSandboxUser {
+		// Игрок появится в песочнице после первой покупки
+		if _, _, _, err = buy(p, b); err == nil {
+			before, err = balance()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	order_id, item, first, err := buy(p, b)
+	if err != nil {
+		return err
+	}
+	params := func() url.Values {
+		return p.orderStatusChange(order_id, b.User_id, b.Receiver_id, item, b.Item, "refunded")
+	}
+
+	type result struct {
+		refund orderResp
+		e      *vkError
+		err    error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			refund, e, err := p.sendOrder(params(), 0)
+			results <- result{refund, e, err}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		res := <-results
+		// Одновременный возврат может получить временную ошибку, VK его повторит
+		if res.err == nil && res.e != nil && res.e.Error_code == 2 && !res.e.Critical {
+			continue
+		}
+		if err = expectOK("concurrent refund", res.e, res.err); err != nil {
+			return err
+		}
+		if res.refund.App_order_id != first.App_order_id {
+			return fmt.Errorf("refund got app_order_id %d, order was %d", res.refund.App_order_id, first.App_order_id)
+		}
+	}
+
+	refund, e, err := p.sendOrder(params(), 0)
+	if err = expectOK("repeated refund", e, err); err != nil {
+		return err
+	}
+	if refund.App_order_id != first.App_order_id {
+		return fmt.Errorf("refund got app_order_id %d, order was %d", refund.App_order_id, first.App_order_id)
+	}
+
+	after, err := balance()
+	if err != nil {
+		return err
+	}
+	if after != before {
+		return fmt.Errorf("balance was %d before purchase and %d after refunds, purchase revoked more than once or not at all", before, after)
+	}
+	return nil
+}
+
+// VK не дождался ответа и оборвал соединение, а pay, возможно, заказ уже
+// сохранил. Повторы должны сойтись на одном заказе.
+func scenarioTimeout(p *platform, b purchase) error {
+	item, e, err := p.sendItem(p.getItem(b.User_id, b.Receiver_id, b.Item, b.Lang))
+	if err = expectOK("get_item", e, err); err != nil {
+		return err
+	}
+
+	order_id := newOrderID()
+	params := p.orderStatusChange(order_id, b.User_id, b.Receiver_id, item, b.Item, "chargeable")
+	p.sendOrder(params, time.Millisecond)
+	// Даем pay закончить оборванный запрос
+	time.Sleep(200 * time.Millisecond)
+
+	first, e, err := p.sendOrder(p.orderStatusChange(order_id, b.User_id, b.Receiver_id, item, b.Item, "chargeable"), 0)
+	if err = expectOK("retry after timeout", e, err); err != nil {
+		return err
+	}
+	again, e, err := p.sendOrder(p.orderStatusChange(order_id, b.User_id, b.Receiver_id, item, b.Item, "chargeable"), 0)
+	if err = expectOK("second retry", e, err); err != nil {
+		return err
+	}
+	if again.App_order_id != first.App_order_id {
+		return fmt.Errorf("retries got app_order_id %d and %d", first.App_order_id, again.App_order_id)
+	}
+	return nil
+}
+
+func scenarioUnknownItem(p *platform, b purchase) error {
+	_, e, err := p.sendItem(p.getItem(b.User_id, b.Receiver_id, "vkfake_unknown_item", b.Lang))
+	if err != nil {
+		return err
+	}
+	if e == nil || e.Error_code != 20 || !e.Critical {
+		return fmt.Errorf("expected critical error 20 for unknown item, got %+v", e)
+	}
+	return nil
+}
+
+// Без ключа сценарий пропускается: pay принимает неподписанные уведомления
+// песочницы только при VK_ALLOW_UNSIGNED
+func scenarioBadSignature(p *platform, b purchase) error {
+	if p.Secret == "" {
+		return errSkipped
+	}
+	bad := *p
+	bad.Secret = p.Secret + "x"
+	_, e, err := bad.sendItem(bad.getItem(b.User_id, b.Receiver_id, b.Item, b.Lang))
+	if err != nil {
+		return err
+	}
+	if e == nil || e.Error_code != 10 {
+		return fmt.Errorf("expected error 10 for bad signature, got %+v", e)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ответ callback платежей: либо response, либо error
+type vkResponse struct {
+	Response json.RawMessage `json:"response"`
+	Error    *vkError        `json:"error"`
+}
+
+type vkError struct {
+	Error_code int    `json:"error_code"`
+	Error_msg  string `json:"error_msg"`
+	Critical   bool   `json:"critical"`
+}
+
+type itemResp struct {
+	Title      string `json:"title"`
+	Photo_url  string `json:"photo_url"`
+	Price      int    `json:"price"`
+	Item_id    string `json:"item_id"`
+	Expiration int    `json:"expiration"`
+}
+
+type orderResp struct {
+	Order_id     int `json:"order_id"`
+	App_order_id int `json:"app_order_id"`
+}
+
+// Платформа VK: куда и от имени какого приложения слать уведомления
+type platform struct {
+	URL      string
+	App_id   int
+	Secret   string
+	Test     bool          //Тестовые уведомления (get_item_test, order_status_change_test)
+	Deadline time.Duration //Сколько VK ждет ответа
+	client   *http.Client
+}
+
+// sign - подпись VK: md5 от "ключ=значение" всех параметров по порядку ключей и секрета
+func sign(params url.Values, secret string) string {
+	keys := []string{}
+	for key := range params {
+		if key != "sig" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key + "=" + params.Get(key))
+	}
+	b.WriteString(secret)
+
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *platform) notificationType(name string) string {
+	if p.Test {
+		return name + "_test"
+	}
+	return name
+}
+
+func (p *platform) getItem(user_id int, receiver_id int, item string, lang string) url.Values {
+	params := url.Values{}
+	params.Set("notification_type", p.notificationType("get_item"))
+	params.Set("app_id", strconv.Itoa(p.App_id))
+	params.Set("user_id", strconv.Itoa(user_id))
+	params.Set("receiver_id", strconv.Itoa(receiver_id))
+	params.Set("order_id", strconv.Itoa(newOrderID()))
+	params.Set("item", item)
+	params.Set("lang", lang)
+	return params
+}
+
+func (p *platform) orderStatusChange(order_id int, user_id int, receiver_id int, item itemResp, name string, status string) url.Values {
+	params := url.Values{}
+	params.Set("notification_type", p.notificationType("order_status_change"))
+	params.Set("app_id", strconv.Itoa(p.App_id))
+	params.Set("user_id", strconv.Itoa(user_id))
+	params.Set("receiver_id", strconv.Itoa(receiver_id))
+	params.Set("order_id", strconv.Itoa(order_id))
+	params.Set("date", strconv.FormatInt(time.Now().Unix(), 10))
+	params.Set("status", status)
+	params.Set("item", name)
+	params.Set("item_id", item.Item_id)
+	params.Set("item_title", item.Title)
+	params.Set("item_photo_url", item.Photo_url)
+	params.Set("item_price", strconv.Itoa(item.Price))
+	return params
+}
+
+var lastOrderID int
+
+// newOrderID - номер заказа VK, уникальный между запусками
+func newOrderID() int {
+	id := int(time.Now().UnixNano()/int64(time.Millisecond)) % 1000000000
+	if id <= lastOrderID {
+		id = lastOrderID + 1
+	}
+	lastOrderID = id
+	return id
+}
+
+// send подписывает и отправляет уведомление, проверяет ответ по контракту
+// callback и возвращает его
+func (p *platform) send(params url.Values, timeout time.Duration) (vkResponse, error) {
+	var rsp vkResponse
+	params.Set("sig", sign(params, p.Secret))
+
+	client := p.client
+	if timeout > 0 {
+		client = &http.Client{Timeout: timeout}
+	}
+
+	start := time.Now()
+	resp, err := client.PostForm(p.URL, params)
+	if err != nil {
+		return rsp, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return rsp, err
+	}
+	elapsed := time.Since(start)
+
+	// Контракт: всегда 200 и json, ровно одно из response и error
+	if resp.StatusCode != http.StatusOK {
+		return rsp, fmt.Errorf("http status %d, VK expects 200: %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return rsp, fmt.Errorf("content type %q, VK expects application/json", ct)
+	}
+	if elapsed > p.Deadline {
+		return rsp, fmt.Errorf("answered in %v, VK waits %v", elapsed, p.Deadline)
+	}
+	err = json.Unmarshal(body, &rsp)
+	if err != nil {
+		return rsp, fmt.Errorf("bad json %q: %v", body, err)
+	}
+	hasResponse := len(rsp.Response) > 0 && string(rsp.Response) != "null"
+	if hasResponse == (rsp.Error != nil) {
+		return rsp, fmt.Errorf("expected exactly one of response and error: %s", body)
+	}
+	if rsp.Error != nil && (rsp.Error.Error_code <= 0 || rsp.Error.Error_msg == "") {
+		return rsp, fmt.Errorf("error without code or message: %s", body)
+	}
+	return rsp, nil
+}
+
+func (p *platform) sendItem(params url.Values) (itemResp, *vkError, error) {
+	var item itemResp
+	rsp, err := p.send(params, 0)
+	if err != nil || rsp.Error != nil {
+		return item, rsp.Error, err
+	}
+	err = json.Unmarshal(rsp.Response, &item)
+	if err != nil {
+		return item, nil, fmt.Errorf("get_item response: %v", err)
+	}
+	if item.Title == "" || item.Price <= 0 || item.Expiration < 0 {
+		return item, nil, fmt.Errorf("get_item response needs title, price > 0 and expiration >= 0: %s", rsp.Response)
+	}
+	return item, nil, nil
+}
+
+func (p *platform) sendOrder(params url.Values, timeout time.Duration) (orderResp, *vkError, error) {
+	var order orderResp
+	rsp, err := p.send(params, timeout)
+	if err != nil || rsp.Error != nil {
+		return order, rsp.Error, err
+	}
+	err = json.Unmarshal(rsp.Response, &order)
+	if err != nil {
+		return order, nil, fmt.Errorf("order_status_change response: %v", err)
+	}
+	if strconv.Itoa(order.Order_id) != params.Get("order_id") || order.App_order_id <= 0 {
+		return order, nil, fmt.Errorf("order_status_change response needs order_id %s and app_order_id > 0: %s", params.Get("order_id"), rsp.Response)
+	}
+	return order, nil, nil
+}
+
+var errNoSandboxUser = errors.New("no sandbox user")
+
+// sandboxBalance - сумма жизней и подсказок игрока в песочнице pay
+// (GET /test/users/{user}). Игрок появляется там после первой тестовой покупки.
+func (p *platform) sandboxBalance(user_id int) (int, error) {
+	base, err := url.Parse(p.URL)
+	if err != nil {
+		return 0, err
+	}
+	u, err := base.Parse("test/users/" + strconv.Itoa(user_id))
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := p.client.Get(u.String())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errNoSandboxUser
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("sandbox user: http status %d", resp.StatusCode)
+	}
+
+	var user map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	if err != nil {
+		return 0, fmt.Errorf("sandbox user: %v", err)
+	}
+	total := 0
+	for _, key := range []string{"live_count", "hint_fstep", "hint_back"} {
+		n, _ := strconv.Atoi(user[key])
+		total += n
+	}
+	return total, nil
+}